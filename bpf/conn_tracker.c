@@ -3,23 +3,48 @@
 #include "vmlinux.h"
 #include <bpf/bpf_helpers.h>
 #include <bpf/bpf_core_read.h>
+#include <bpf/bpf_endian.h>
 
-// Avoid system bpf_tracing.h PT_REGS macros, use our own
-#undef PT_REGS_PARM1
-#undef PT_REGS_PARM2  
-#undef PT_REGS_PARM3
+// PT_REGS_PARM* come from vmlinux.h rather than bpf_tracing.h
+#define MAX_ENTRIES 10240
+#define TASK_COMM_LEN 16
+#define MAX_PID_NS_LEVEL 32
+#define MAX_CONNECTIONS 65536
 
-typedef __u64 size_t;
+#define AF_INET 2
+#define AF_INET6 10
 
-#define MAX_ENTRIES 10240
+#define DNS_PORT 53
+#define DNS_MAX_LEN 512
+// iovecs read from a TCP send, glibc writes the length prefix and the
+// message as two
+#define DNS_TCP_SEGMENTS 2
+
+#define HOSTNAME_MAX 128
+#define RESOLVE_MAX_ADDRS 8
+// addrinfo entries walked per lookup, glibc lists each address once per socket type
+#define RESOLVE_MAX_ENTRIES 16
+
+// Address offsets in the IPv4 and IPv6 headers
+#define IPV4_SADDR_OFF 12
+#define IPV4_DADDR_OFF 16
+#define IPV6_SADDR_OFF 8
+#define IPV6_DADDR_OFF 24
+
+// Addresses are in network byte order; IPv4 only uses saddr[0]/daddr[0].
+struct conn_tuple {
+    __u32 saddr[4];
+    __u32 daddr[4];
+    __u16 sport;
+    __u16 dport;
+    __u16 family;
+    __u32 netns;
+};
 
 struct conn_event {
     __u32 pid;
     __u32 tid;
-    __u32 saddr;
-    __u32 daddr;
-    __u16 sport;
-    __u16 dport;
+    struct conn_tuple tuple;
     __u8 event_type;
     __u8 protocol;
     __u64 timestamp;
@@ -29,14 +54,125 @@ struct conn_event {
     __u32 duration_ms;
     __u8 tcp_state;
     __u8 reset_reason;
+    __u8 direction;
+    __u8 prev_tcp_state;
+    __u32 rtt_var_us;
+    __u32 retransmits;
+    __u16 rto_count;
+    __u16 tlp_count;
+    __u16 sk_err;
+    __u8 idle;
+    __u32 connect_us;
+    char comm[TASK_COMM_LEN];
+    __u64 cgroup_id;
+    __u32 ns_pid;
 };
 
+// Running totals of a tracked connection. Userspace reads them periodically
+// to report traffic of open connections. The owner is recorded when the
+// connection is made, most later hooks run in softirq or timer context
+// where the current task is unrelated.
 struct conn_state {
     __u64 start_time;
     __u64 bytes_sent;
     __u64 bytes_received;
     __u32 last_rtt;
+    __u32 rtt_var;
+    __u32 retransmits;
+    __u16 rto_count;
+    __u16 tlp_count;
+    __u64 last_activity;
     __u8 tcp_state;
+    __u8 direction;
+    __u32 pid;
+    char comm[TASK_COMM_LEN];
+    __u64 cgroup_id;
+    __u32 ns_pid;
+    __u32 tid;
+};
+
+// UDP has no connections, datagrams are aggregated into flows by tuple and
+// userspace closes flows that saw no traffic for a while.
+struct udp_flow {
+    __u64 start_time;
+    __u64 last_activity;
+    __u64 bytes_sent;
+    __u64 bytes_received;
+    __u32 pid;
+    __u8 direction;
+    char comm[TASK_COMM_LEN];
+    __u64 cgroup_id;
+    __u32 ns_pid;
+};
+
+// udp_sendmsg/udp_recvmsg arguments, needed again on return.
+struct udp_args {
+    struct sock *sk;
+    struct msghdr *msg;
+};
+
+// Key of tcp_state_counts.
+struct tcp_state_key {
+    __u32 netns;
+    __u32 state;
+};
+
+// tcp_recvmsg arguments on a DNS connection, needed again on return.
+struct dns_args {
+    struct conn_tuple tuple;
+    void *buf;
+    __u64 buf_len;
+};
+
+// A DNS message sent or received on a UDP socket, or a piece of a TCP DNS
+// stream, parsed in userspace. saddr/sport in the tuple are the local side.
+// size is the length of the datagram or stream piece, payload holds its
+// first len bytes.
+struct dns_event {
+    __u64 timestamp;
+    __u32 pid;
+    __u32 tid;
+    __u32 ns_pid;
+    struct conn_tuple tuple;
+    char comm[TASK_COMM_LEN];
+    __u32 size;
+    __u16 len;
+    __u8 direction;
+    __u8 protocol;
+    __u8 payload[DNS_MAX_LEN];
+};
+
+// Addresses a process resolved a hostname to with getaddrinfo.
+struct resolve_event {
+    __u64 timestamp;
+    __u32 pid;
+    __u32 count;
+    __u16 family[RESOLVE_MAX_ADDRS];
+    __u32 addrs[RESOLVE_MAX_ADDRS][4];
+    char hostname[HOSTNAME_MAX];
+};
+
+// struct addrinfo as laid out by glibc and musl on 64-bit targets.
+struct user_addrinfo {
+    int ai_flags;
+    int ai_family;
+    int ai_socktype;
+    int ai_protocol;
+    __u32 ai_addrlen;
+    void *ai_addr;
+    char *ai_canonname;
+    struct user_addrinfo *ai_next;
+};
+
+// getaddrinfo arguments, needed again on return.
+struct resolve_args {
+    const char *node;
+    struct user_addrinfo **res;
+};
+
+// Settings written by userspace at load time.
+struct tracker_config {
+    __u64 idle_threshold_ns;
 };
 
 enum event_type {
@@ -46,6 +182,9 @@ enum event_type {
     CONN_RESET = 4,
     CONN_FAILED = 5,
     CONN_DATA = 6,
+    CONN_STATE = 7,
+    CONN_ACTIVE = 8,
+    PROC_EXIT = 9,
 };
 
 enum protocol_type {
@@ -54,11 +193,19 @@ enum protocol_type {
     PROTO_UNKNOWN = 0,
 };
 
+enum direction {
+    DIR_UNKNOWN = 0,
+    DIR_OUTBOUND = 1,
+    DIR_INBOUND = 2,
+};
+
 enum reset_reason {
     RESET_NORMAL = 0,
     RESET_TIMEOUT = 1,
     RESET_REFUSED = 2,
     RESET_ABORT = 3,
+    RESET_LOCAL = 4,
+    RESET_REMOTE = 5,
 };
 
 struct {
@@ -67,14 +214,248 @@ struct {
 } events SEC(".maps");
 
 struct {
-    __uint(type, BPF_MAP_TYPE_HASH);
-    __type(key, __u32);
+    __uint(type, BPF_MAP_TYPE_LRU_HASH);
+    __type(key, struct conn_tuple);
     __type(value, struct conn_state);
-    __uint(max_entries, MAX_ENTRIES);
+    __uint(max_entries, MAX_CONNECTIONS);
 } conn_state_map SEC(".maps");
 
-static __always_inline __u32 make_conn_key(__u32 saddr, __u32 daddr, __u16 sport, __u16 dport) {
-    return saddr ^ daddr ^ ((__u32)sport << 16) ^ (__u32)dport;
+struct {
+    __uint(type, BPF_MAP_TYPE_ARRAY);
+    __type(key, __u32);
+    __type(value, struct tracker_config);
+    __uint(max_entries, 1);
+} config_map SEC(".maps");
+
+struct {
+    __uint(type, BPF_MAP_TYPE_LRU_HASH);
+    __type(key, struct conn_tuple);
+    __type(value, struct udp_flow);
+    __uint(max_entries, MAX_CONNECTIONS);
+} udp_flow_map SEC(".maps");
+
+// UDP send/receive calls in flight, keyed by pid_tgid.
+struct {
+    __uint(type, BPF_MAP_TYPE_HASH);
+    __type(key, __u64);
+    __type(value, struct udp_args);
+    __uint(max_entries, MAX_ENTRIES);
+} udp_args_map SEC(".maps");
+
+// Sockets that entered each TCP state minus those that left it, per
+// network namespace, for every socket on the host. Userspace adds the
+// counts sock_diag listed when they were last reconciled.
+struct {
+    __uint(type, BPF_MAP_TYPE_PERCPU_HASH);
+    __type(key, struct tcp_state_key);
+    __type(value, __s64);
+    __uint(max_entries, MAX_ENTRIES);
+} tcp_state_counts SEC(".maps");
+
+struct {
+    __uint(type, BPF_MAP_TYPE_RINGBUF);
+    __uint(max_entries, 256 * 1024);
+} dns_events SEC(".maps");
+
+// TCP DNS receive calls in flight, keyed by pid_tgid.
+struct {
+    __uint(type, BPF_MAP_TYPE_HASH);
+    __type(key, __u64);
+    __type(value, struct dns_args);
+    __uint(max_entries, MAX_ENTRIES);
+} dns_args_map SEC(".maps");
+
+struct {
+    __uint(type, BPF_MAP_TYPE_RINGBUF);
+    __uint(max_entries, 64 * 1024);
+} resolve_events SEC(".maps");
+
+// getaddrinfo calls in flight, keyed by pid_tgid.
+struct {
+    __uint(type, BPF_MAP_TYPE_HASH);
+    __type(key, __u64);
+    __type(value, struct resolve_args);
+    __uint(max_entries, MAX_ENTRIES);
+} resolve_args_map SEC(".maps");
+
+// Close events pending on tcp_close return, keyed by pid_tgid.
+struct {
+    __uint(type, BPF_MAP_TYPE_HASH);
+    __type(key, __u64);
+    __type(value, struct conn_event);
+    __uint(max_entries, MAX_ENTRIES);
+} closing_map SEC(".maps");
+
+// Connections in conn_state_map that are idle, with the last_activity they
+// were idle since. Kept apart from conn_state so userspace can mark a
+// connection idle without writing back counters the kernel owns.
+struct {
+    __uint(type, BPF_MAP_TYPE_LRU_HASH);
+    __type(key, struct conn_tuple);
+    __type(value, __u64);
+    __uint(max_entries, MAX_CONNECTIONS);
+} idle_map SEC(".maps");
+
+// reserve_event zeroes the reserved record, ring buffer memory is not cleared.
+// forget_conn stops tracking a connection.
+static __always_inline void forget_conn(struct conn_tuple *tuple) {
+    bpf_map_delete_elem(&conn_state_map, tuple);
+    bpf_map_delete_elem(&idle_map, tuple);
+}
+
+static __always_inline struct conn_event *reserve_event(void) {
+    struct conn_event *event = bpf_ringbuf_reserve(&events, sizeof(*event), 0);
+
+    if (event)
+        __builtin_memset(event, 0, sizeof(*event));
+    return event;
+}
+
+// current_ns_pid returns the PID of the current process in its own PID
+// namespace, the one ps and /proc show inside its container.
+static __always_inline __u32 current_ns_pid(void) {
+    struct task_struct *task = (struct task_struct *)bpf_get_current_task();
+    struct task_struct *leader = NULL;
+    struct pid *pid = NULL;
+    unsigned int level = 0;
+    struct upid upid = {};
+
+    BPF_CORE_READ_INTO(&leader, task, group_leader);
+    BPF_CORE_READ_INTO(&pid, leader, thread_pid);
+    BPF_CORE_READ_INTO(&level, pid, level);
+    // numbers[] holds one entry per namespace level, the last is the innermost
+    bpf_probe_read_kernel(&upid, sizeof(upid), pid->numbers + (level & (MAX_PID_NS_LEVEL - 1)));
+    return upid.nr;
+}
+
+// read_netns returns the inode number of the socket's network namespace,
+// as in /proc/<pid>/ns/net.
+static __always_inline __u32 read_netns(struct sock *sk) {
+    struct net *net = NULL;
+    __u32 inum = 0;
+
+    BPF_CORE_READ_INTO(&net, sk, __sk_common.skc_net.net);
+    BPF_CORE_READ_INTO(&inum, net, ns.inum);
+    return inum;
+}
+
+// inet_sock's inet_daddr/inet_dport are macros over sock_common, so read the
+// tuple from sock_common directly to work against both BTF and fallback headers.
+// The network namespace is part of the tuple, containers reuse addresses.
+static __always_inline void read_conn_tuple(struct sock *sk, struct conn_tuple *t) {
+    // Zero the padding too, the tuple is used as a hash map key.
+    __builtin_memset(t, 0, sizeof(*t));
+    BPF_CORE_READ_INTO(&t->family, sk, __sk_common.skc_family);
+    BPF_CORE_READ_INTO(&t->sport, sk, __sk_common.skc_num);
+    BPF_CORE_READ_INTO(&t->dport, sk, __sk_common.skc_dport);
+    t->dport = bpf_ntohs(t->dport);
+    t->netns = read_netns(sk);
+
+    if (t->family == AF_INET6) {
+        BPF_CORE_READ_INTO(&t->saddr, sk, __sk_common.skc_v6_rcv_saddr.in6_u.u6_addr32);
+        BPF_CORE_READ_INTO(&t->daddr, sk, __sk_common.skc_v6_daddr.in6_u.u6_addr32);
+    } else {
+        BPF_CORE_READ_INTO(&t->saddr[0], sk, __sk_common.skc_rcv_saddr);
+        BPF_CORE_READ_INTO(&t->daddr[0], sk, __sk_common.skc_daddr);
+    }
+}
+
+// srtt_us is stored left-shifted by 3 and mdev_us by 2.
+static __always_inline void read_rtt(struct sock *sk, __u32 *rtt, __u32 *rtt_var) {
+    struct tcp_sock *tp = (struct tcp_sock *)sk;
+    __u32 srtt = 0, mdev = 0;
+
+    BPF_CORE_READ_INTO(&srtt, tp, srtt_us);
+    BPF_CORE_READ_INTO(&mdev, tp, mdev_us);
+    *rtt = srtt >> 3;
+    *rtt_var = mdev >> 2;
+}
+
+// bytes_acked and bytes_received count payload the peer acknowledged and
+// payload actually received, unlike the sendmsg/recvmsg size arguments.
+static __always_inline void read_bytes(struct sock *sk, __u64 *sent, __u64 *received) {
+    struct tcp_sock *tp = (struct tcp_sock *)sk;
+
+    BPF_CORE_READ_INTO(sent, tp, bytes_acked);
+    BPF_CORE_READ_INTO(received, tp, bytes_received);
+}
+
+// fill_conn_event fills an event from the socket and its tracked state.
+static __always_inline void fill_conn_event(struct conn_event *event, struct sock *sk, struct conn_tuple *tuple,
+                                          struct conn_state *state, __u8 event_type, __u8 reset_reason) {
+    __u64 now = bpf_ktime_get_ns();
+
+    event->pid = state->pid;
+    event->tid = state->tid;
+    event->timestamp = now;
+    event->event_type = event_type;
+    event->protocol = PROTO_TCP;
+    event->reset_reason = reset_reason;
+    event->tuple = *tuple;
+    event->duration_ms = (now - state->start_time) / 1000000; // ns to ms
+    event->tcp_state = state->tcp_state;
+    event->direction = state->direction;
+    event->retransmits = state->retransmits;
+    event->rto_count = state->rto_count;
+    event->tlp_count = state->tlp_count;
+    event->idle = bpf_map_lookup_elem(&idle_map, tuple) != NULL;
+    __builtin_memcpy(event->comm, state->comm, sizeof(event->comm));
+    event->cgroup_id = state->cgroup_id;
+    event->ns_pid = state->ns_pid;
+
+    read_rtt(sk, &event->rtt_us, &event->rtt_var_us);
+    read_bytes(sk, &event->bytes_sent, &event->bytes_received);
+}
+
+// emit_reset reports a tracked connection torn down by a reset or an error
+// and stops tracking it, so the following tcp_close does not report it again.
+static __always_inline int emit_reset(struct sock *sk, __u8 reset_reason) {
+    struct conn_event *event;
+    struct conn_state *state;
+    struct conn_tuple tuple;
+
+    if (!sk)
+        return 0;
+
+    read_conn_tuple(sk, &tuple);
+    state = bpf_map_lookup_elem(&conn_state_map, &tuple);
+    if (!state)
+        return 0;
+
+    // Connect failures are reported on the SYN_SENT -> CLOSE transition
+    if (state->tcp_state == TCP_SYN_SENT)
+        return 0;
+
+    event = reserve_event();
+    if (event) {
+        fill_conn_event(event, sk, &tuple, state, CONN_RESET, reset_reason);
+        bpf_ringbuf_submit(event, 0);
+    }
+
+    forget_conn(&tuple);
+    return 0;
+}
+
+// emit_connect_failure reports a connect attempt that never got established.
+// sk_err holds the reason: ECONNREFUSED after a reset, ETIMEDOUT or the last
+// ICMP error (sk_err_soft) when SYN retransmissions ran out, EHOSTUNREACH or
+// ENETUNREACH on ICMP errors. It is 0 when the application gave up first.
+static __always_inline void emit_connect_failure(struct sock *sk, struct conn_tuple *tuple, struct conn_state *state) {
+    struct conn_event *event;
+    int err = 0;
+
+    event = reserve_event();
+    if (event) {
+        fill_conn_event(event, sk, tuple, state, CONN_FAILED, RESET_NORMAL);
+        event->connect_us = (event->timestamp - state->start_time) / 1000;
+        BPF_CORE_READ_INTO(&err, sk, sk_err);
+        if (!err)
+            BPF_CORE_READ_INTO(&err, sk, sk_err_soft);
+        event->sk_err = err;
+        bpf_ringbuf_submit(event, 0);
+    }
+
+    forget_conn(tuple);
 }
 
 SEC("kprobe/tcp_connect")
@@ -83,8 +464,9 @@ int trace_tcp_connect(struct pt_regs *ctx)
     struct sock *sk = (struct sock *)PT_REGS_PARM1(ctx);
     struct conn_event *event;
     struct conn_state state = {};
+    struct conn_tuple tuple;
     
-    event = bpf_ringbuf_reserve(&events, sizeof(*event), 0);
+    event = reserve_event();
     if (!event)
         return 0;
 
@@ -94,42 +476,55 @@ int trace_tcp_connect(struct pt_regs *ctx)
     event->timestamp = now;
     event->event_type = CONN_OPEN;
     event->protocol = PROTO_TCP;
+    event->prev_tcp_state = 0;
     event->bytes_sent = 0;
     event->bytes_received = 0;
     event->rtt_us = 0;
+    event->rtt_var_us = 0;
     event->duration_ms = 0;
-    event->tcp_state = 1; // TCP_ESTABLISHED
+    event->tcp_state = TCP_SYN_SENT;
     event->reset_reason = RESET_NORMAL;
+    event->direction = DIR_OUTBOUND;
+    bpf_get_current_comm(event->comm, sizeof(event->comm));
+    event->cgroup_id = bpf_get_current_cgroup_id();
+    event->ns_pid = current_ns_pid();
 
-    struct inet_sock *inet = (struct inet_sock *)sk;
-    BPF_CORE_READ_INTO(&event->saddr, inet, inet_saddr);
-    BPF_CORE_READ_INTO(&event->daddr, inet, inet_daddr);
-    BPF_CORE_READ_INTO(&event->sport, inet, inet_sport);
-    BPF_CORE_READ_INTO(&event->dport, inet, inet_dport);
-
-    __u32 conn_key = make_conn_key(event->saddr, event->daddr, event->sport, event->dport);
+    read_conn_tuple(sk, &tuple);
+    event->tuple = tuple;
     
     // Initialize connection state
     state.start_time = now;
+    state.last_activity = now;
     state.bytes_sent = 0;
     state.bytes_received = 0;
     state.last_rtt = 0;
-    state.tcp_state = 1;
+    state.tcp_state = TCP_SYN_SENT;
+    state.direction = DIR_OUTBOUND;
+    state.pid = event->pid;
+    state.tid = event->tid;
+    __builtin_memcpy(state.comm, event->comm, sizeof(state.comm));
+    state.cgroup_id = event->cgroup_id;
+    state.ns_pid = event->ns_pid;
     
-    bpf_map_update_elem(&conn_state_map, &conn_key, &state, BPF_ANY);
+    bpf_map_update_elem(&conn_state_map, &tuple, &state, BPF_ANY);
 
     bpf_ringbuf_submit(event, 0);
     return 0;
 }
 
-SEC("kprobe/tcp_close")
-int trace_tcp_close(struct pt_regs *ctx)
+// Accepted sockets are returned by inet_csk_accept, trace them as inbound.
+SEC("kretprobe/inet_csk_accept")
+int trace_inet_csk_accept(struct pt_regs *ctx)
 {
-    struct sock *sk = (struct sock *)PT_REGS_PARM1(ctx);
+    struct sock *sk = (struct sock *)PT_REGS_RC(ctx);
     struct conn_event *event;
-    struct conn_state *state;
-    
-    event = bpf_ringbuf_reserve(&events, sizeof(*event), 0);
+    struct conn_state state = {};
+    struct conn_tuple tuple;
+
+    if (!sk)
+        return 0;
+
+    event = reserve_event();
     if (!event)
         return 0;
 
@@ -137,109 +532,409 @@ int trace_tcp_close(struct pt_regs *ctx)
     event->pid = bpf_get_current_pid_tgid() >> 32;
     event->tid = bpf_get_current_pid_tgid();
     event->timestamp = now;
-    event->event_type = CONN_CLOSE;
+    event->event_type = CONN_OPEN;
     event->protocol = PROTO_TCP;
+    event->prev_tcp_state = 0;
+    event->bytes_sent = 0;
+    event->bytes_received = 0;
+    event->rtt_us = 0;
+    event->rtt_var_us = 0;
+    event->duration_ms = 0;
+    event->tcp_state = TCP_ESTABLISHED;
     event->reset_reason = RESET_NORMAL;
+    event->direction = DIR_INBOUND;
+    bpf_get_current_comm(event->comm, sizeof(event->comm));
+    event->cgroup_id = bpf_get_current_cgroup_id();
+    event->ns_pid = current_ns_pid();
 
-    struct inet_sock *inet = (struct inet_sock *)sk;
-    BPF_CORE_READ_INTO(&event->saddr, inet, inet_saddr);
-    BPF_CORE_READ_INTO(&event->daddr, inet, inet_daddr);
-    BPF_CORE_READ_INTO(&event->sport, inet, inet_sport);
-    BPF_CORE_READ_INTO(&event->dport, inet, inet_dport);
+    read_conn_tuple(sk, &tuple);
+    event->tuple = tuple;
 
-    __u32 conn_key = make_conn_key(event->saddr, event->daddr, event->sport, event->dport);
-    
-    // Get connection state for duration and byte counts
-    state = bpf_map_lookup_elem(&conn_state_map, &conn_key);
-    if (state) {
-        event->duration_ms = (now - state->start_time) / 1000000; // ns to ms
-        event->bytes_sent = state->bytes_sent;
-        event->bytes_received = state->bytes_received;
-        event->rtt_us = state->last_rtt;
-        event->tcp_state = state->tcp_state;
-        
-        bpf_map_delete_elem(&conn_state_map, &conn_key);
-    } else {
-        event->duration_ms = 0;
-        event->bytes_sent = 0;
-        event->bytes_received = 0;
-        event->rtt_us = 0;
-        event->tcp_state = 0;
+    state.start_time = now;
+    state.last_activity = now;
+    state.tcp_state = TCP_ESTABLISHED;
+    state.direction = DIR_INBOUND;
+    state.pid = event->pid;
+    state.tid = event->tid;
+    __builtin_memcpy(state.comm, event->comm, sizeof(state.comm));
+    state.cgroup_id = event->cgroup_id;
+    state.ns_pid = event->ns_pid;
+
+    bpf_map_update_elem(&conn_state_map, &tuple, &state, BPF_ANY);
+
+    bpf_ringbuf_submit(event, 0);
+    return 0;
+}
+
+// tcp_close may itself reset the peer (SO_LINGER with a zero timeout or
+// unread data) before it returns. Stash the close event on entry and only
+// report it on return if no reset untracked the connection meanwhile.
+SEC("kprobe/tcp_close")
+int trace_tcp_close(struct pt_regs *ctx)
+{
+    struct sock *sk = (struct sock *)PT_REGS_PARM1(ctx);
+    struct conn_event event = {};
+    struct conn_state *state;
+    struct conn_tuple tuple;
+    __u64 pid_tgid = bpf_get_current_pid_tgid();
+
+    read_conn_tuple(sk, &tuple);
+    state = bpf_map_lookup_elem(&conn_state_map, &tuple);
+    if (!state)
+        return 0;
+
+    fill_conn_event(&event, sk, &tuple, state, CONN_CLOSE, RESET_NORMAL);
+    bpf_map_update_elem(&closing_map, &pid_tgid, &event, BPF_ANY);
+    return 0;
+}
+
+SEC("kretprobe/tcp_close")
+int trace_tcp_close_ret(struct pt_regs *ctx)
+{
+    __u64 pid_tgid = bpf_get_current_pid_tgid();
+    struct conn_event *pending, *event;
+
+    pending = bpf_map_lookup_elem(&closing_map, &pid_tgid);
+    if (!pending)
+        return 0;
+
+    if (bpf_map_lookup_elem(&conn_state_map, &pending->tuple)) {
+        forget_conn(&pending->tuple);
+
+        event = bpf_ringbuf_reserve(&events, sizeof(*event), 0);
+        if (event) {
+            __builtin_memcpy(event, pending, sizeof(*event));
+            bpf_ringbuf_submit(event, 0);
+        }
     }
 
+    bpf_map_delete_elem(&closing_map, &pid_tgid);
+    return 0;
+}
+
+static __always_inline void count_tcp_state(__u32 netns, __u32 state, __s64 delta) {
+    struct tcp_state_key key = {};
+    __s64 zero = 0, *count;
+
+    // Sockets are created and torn down in TCP_CLOSE, it is not counted
+    if (state == TCP_CLOSE)
+        return;
+
+    key.netns = netns;
+    key.state = state;
+    count = bpf_map_lookup_elem(&tcp_state_counts, &key);
+    if (!count) {
+        bpf_map_update_elem(&tcp_state_counts, &key, &zero, BPF_NOEXIST);
+        count = bpf_map_lookup_elem(&tcp_state_counts, &key);
+        if (!count)
+            return;
+    }
+    // Per-CPU, no other program touches this slot meanwhile
+    *count += delta;
+}
+
+// Every TCP state change is counted in tcp_state_counts, only those of
+// tracked connections are reported as CONN_STATE so busy hosts do not
+// crowd the ring buffer with sockets nobody asked about.
+SEC("tracepoint/sock/inet_sock_set_state")
+int trace_inet_sock_set_state(struct trace_event_raw_inet_sock_set_state *ctx)
+{
+    struct sock *sk = (struct sock *)ctx->skaddr;
+    struct conn_event *event;
+    struct conn_state *state;
+    struct conn_tuple tuple;
+
+    if (ctx->protocol != IPPROTO_TCP)
+        return 0;
+
+    read_conn_tuple(sk, &tuple);
+
+    // A connection being accepted is cloned from its listener and enters
+    // SYN_RECV from LISTEN, the listener itself keeps listening
+    if (ctx->oldstate != TCP_LISTEN || ctx->newstate != TCP_SYN_RECV)
+        count_tcp_state(tuple.netns, ctx->oldstate, -1);
+    count_tcp_state(tuple.netns, ctx->newstate, 1);
+
+    state = bpf_map_lookup_elem(&conn_state_map, &tuple);
+    if (!state)
+        return 0;
+    if (ctx->oldstate == TCP_SYN_SENT && ctx->newstate == TCP_CLOSE) {
+        emit_connect_failure(sk, &tuple, state);
+        return 0;
+    }
+    state->tcp_state = ctx->newstate;
+
+    event = reserve_event();
+    if (!event)
+        return 0;
+
+    __u64 now = bpf_ktime_get_ns();
+    event->pid = state->pid;
+    event->tid = state->tid;
+    event->timestamp = now;
+    event->event_type = CONN_STATE;
+    event->protocol = PROTO_TCP;
+    event->reset_reason = RESET_NORMAL;
+    event->tuple = tuple;
+    event->tcp_state = ctx->newstate;
+    event->prev_tcp_state = ctx->oldstate;
+    event->duration_ms = (now - state->start_time) / 1000000;
+    event->rtt_us = state->last_rtt;
+    event->rtt_var_us = state->rtt_var;
+    event->direction = state->direction;
+    event->retransmits = state->retransmits;
+    event->rto_count = state->rto_count;
+    event->tlp_count = state->tlp_count;
+    __builtin_memcpy(event->comm, state->comm, sizeof(event->comm));
+    event->cgroup_id = state->cgroup_id;
+    event->ns_pid = state->ns_pid;
+    // Handshake latency, from the SYN sent in tcp_connect
+    if (ctx->oldstate == TCP_SYN_SENT && ctx->newstate == TCP_ESTABLISHED)
+        event->connect_us = (now - state->start_time) / 1000;
+
+    read_bytes(sk, &event->bytes_sent, &event->bytes_received);
+
     bpf_ringbuf_submit(event, 0);
     return 0;
 }
 
+// The keepalive timer is the only hook firing on a connection without
+// traffic, so idle connections are detected when it runs. Sockets without
+// SO_KEEPALIVE are marked idle from userspace on each data flush.
+// tcp_keepalive_timer is handed the socket's sk_timer, the socket is the
+// struct around it.
 SEC("kprobe/tcp_keepalive_timer")
 int trace_tcp_keepalive(struct pt_regs *ctx)
 {
-    struct sock *sk = (struct sock *)PT_REGS_PARM1(ctx);
+    void *timer = (void *)PT_REGS_PARM1(ctx);
+    struct sock *sk = (struct sock *)(timer - bpf_core_field_offset(struct sock, sk_timer));
+    struct tracker_config *config;
     struct conn_event *event;
     struct conn_state *state;
-    __u64 now = bpf_ktime_get_ns();
-    
-    struct inet_sock *inet = (struct inet_sock *)sk;
-    __u32 saddr, daddr;
-    __u16 sport, dport;
-    
-    BPF_CORE_READ_INTO(&saddr, inet, inet_saddr);
-    BPF_CORE_READ_INTO(&daddr, inet, inet_daddr);
-    BPF_CORE_READ_INTO(&sport, inet, inet_sport);
-    BPF_CORE_READ_INTO(&dport, inet, inet_dport);
+    struct conn_tuple tuple;
+    __u32 zero = 0;
 
-    __u32 conn_key = make_conn_key(saddr, daddr, sport, dport);
-    state = bpf_map_lookup_elem(&conn_state_map, &conn_key);
-    
-    if (state && (now - state->start_time) > 30000000000ULL) {
-        event = bpf_ringbuf_reserve(&events, sizeof(*event), 0);
-        if (!event)
-            return 0;
-
-        event->pid = bpf_get_current_pid_tgid() >> 32;
-        event->tid = bpf_get_current_pid_tgid();
-        event->timestamp = now;
-        event->event_type = CONN_IDLE;
-        event->protocol = PROTO_TCP;
-        event->saddr = saddr;
-        event->daddr = daddr;
-        event->sport = sport;
-        event->dport = dport;
-        event->duration_ms = (now - state->start_time) / 1000000;
-        event->bytes_sent = state->bytes_sent;
-        event->bytes_received = state->bytes_received;
-        event->rtt_us = state->last_rtt;
-        event->tcp_state = state->tcp_state;
-        event->reset_reason = RESET_NORMAL;
+    config = bpf_map_lookup_elem(&config_map, &zero);
+    if (!config || !config->idle_threshold_ns)
+        return 0;
+
+    read_conn_tuple(sk, &tuple);
+
+    state = bpf_map_lookup_elem(&conn_state_map, &tuple);
+    if (!state)
+        return 0;
 
+    if (bpf_ktime_get_ns() - state->last_activity < config->idle_threshold_ns)
+        return 0;
+
+    // Fails when the connection is idle already
+    if (bpf_map_update_elem(&idle_map, &tuple, &state->last_activity, BPF_NOEXIST))
+        return 0;
+
+    event = reserve_event();
+    if (event) {
+        fill_conn_event(event, sk, &tuple, state, CONN_IDLE, RESET_NORMAL);
         bpf_ringbuf_submit(event, 0);
     }
 
     return 0;
 }
 
+// Sample the smoothed RTT on the established fast path so in-flight state
+// stays current between connect and close.
+SEC("kprobe/tcp_rcv_established")
+int trace_tcp_rcv_established(struct pt_regs *ctx)
+{
+    struct sock *sk = (struct sock *)PT_REGS_PARM1(ctx);
+    struct conn_state *state;
+    struct conn_tuple tuple;
+
+    read_conn_tuple(sk, &tuple);
+    state = bpf_map_lookup_elem(&conn_state_map, &tuple);
+    if (state)
+        read_rtt(sk, &state->last_rtt, &state->rtt_var);
+
+    return 0;
+}
+
+SEC("tracepoint/tcp/tcp_retransmit_skb")
+int trace_tcp_retransmit_skb(struct trace_event_raw_tcp_event_sk_skb *ctx)
+{
+    struct sock *sk = (struct sock *)ctx->skaddr;
+    struct conn_state *state;
+    struct conn_tuple tuple;
+
+    read_conn_tuple(sk, &tuple);
+    state = bpf_map_lookup_elem(&conn_state_map, &tuple);
+    if (state)
+        __sync_fetch_and_add(&state->retransmits, 1);
+
+    return 0;
+}
+
+SEC("kprobe/tcp_retransmit_timer")
+int trace_tcp_retransmit_timer(struct pt_regs *ctx)
+{
+    struct sock *sk = (struct sock *)PT_REGS_PARM1(ctx);
+    struct conn_state *state;
+    struct conn_tuple tuple;
+
+    read_conn_tuple(sk, &tuple);
+    state = bpf_map_lookup_elem(&conn_state_map, &tuple);
+    if (state)
+        __sync_fetch_and_add(&state->rto_count, 1);
+
+    return 0;
+}
+
+SEC("kprobe/tcp_send_loss_probe")
+int trace_tcp_send_loss_probe(struct pt_regs *ctx)
+{
+    struct sock *sk = (struct sock *)PT_REGS_PARM1(ctx);
+    struct conn_state *state;
+    struct conn_tuple tuple;
+
+    read_conn_tuple(sk, &tuple);
+    state = bpf_map_lookup_elem(&conn_state_map, &tuple);
+    if (state)
+        __sync_fetch_and_add(&state->tlp_count, 1);
+
+    return 0;
+}
+
+// mark_active records traffic on a connection and reports it when it was idle.
+static __always_inline void mark_active(struct sock *sk, struct conn_tuple *tuple, struct conn_state *state) {
+    struct conn_event *event;
+
+    state->last_activity = bpf_ktime_get_ns();
+    // Only the caller that removes the entry reports the connection active
+    if (bpf_map_delete_elem(&idle_map, tuple))
+        return;
+
+    event = reserve_event();
+    if (event) {
+        fill_conn_event(event, sk, tuple, state, CONN_ACTIVE, RESET_NORMAL);
+        bpf_ringbuf_submit(event, 0);
+    }
+}
+
+static __always_inline int is_dns(struct conn_tuple *t) {
+    return t->sport == DNS_PORT || t->dport == DNS_PORT;
+}
+
+// read_iovecs returns the first user buffers of a sendmsg or recvmsg call,
+// at most DNS_TCP_SEGMENTS and count bytes in total. The number of buffers
+// is returned.
+static __always_inline int read_iovecs(struct msghdr *msg, struct iovec *segs) {
+    struct iov_iter *iter = &msg->msg_iter;
+    const struct iovec *iov = NULL;
+    unsigned long offset = 0, count = 0;
+    __u8 type = 0;
+
+    BPF_CORE_READ_INTO(&offset, iter, iov_offset);
+    BPF_CORE_READ_INTO(&count, iter, count);
+
+    // Single-buffer reads and writes use ITER_UBUF since 6.0
+    if (bpf_core_field_exists(iter->ubuf) && bpf_core_enum_value_exists(enum iter_type, ITER_UBUF)) {
+        BPF_CORE_READ_INTO(&type, iter, iter_type);
+        if (type == bpf_core_enum_value(enum iter_type, ITER_UBUF)) {
+            BPF_CORE_READ_INTO(&segs[0].iov_base, iter, ubuf);
+            segs[0].iov_base += offset;
+            segs[0].iov_len = count;
+            return 1;
+        }
+    }
+
+    if (bpf_core_field_exists(iter->__iov))
+        BPF_CORE_READ_INTO(&iov, iter, __iov);
+    else
+        BPF_CORE_READ_INTO(&iov, (struct iov_iter___old *)iter, iov);
+    if (!iov)
+        return 0;
+    // The array is the kernel's copy, sized for at least UIO_FASTIOV entries
+    bpf_probe_read_kernel(segs, DNS_TCP_SEGMENTS * sizeof(*segs), iov);
+
+    if (segs[0].iov_len < offset)
+        return 0;
+    segs[0].iov_base += offset;
+    segs[0].iov_len -= offset;
+    if (segs[0].iov_len >= count) {
+        segs[0].iov_len = count;
+        return 1;
+    }
+    if (segs[1].iov_len > count - segs[0].iov_len)
+        segs[1].iov_len = count - segs[0].iov_len;
+    return 2;
+}
+
+// reserve_dns reserves a DNS event for the current process.
+static __always_inline struct dns_event *reserve_dns(__u8 protocol, __u8 direction) {
+    __u64 pid_tgid = bpf_get_current_pid_tgid();
+    struct dns_event *event;
+
+    event = bpf_ringbuf_reserve(&dns_events, sizeof(*event), 0);
+    if (!event)
+        return NULL;
+    __builtin_memset(event, 0, sizeof(*event));
+
+    event->timestamp = bpf_ktime_get_ns();
+    event->pid = pid_tgid >> 32;
+    event->tid = pid_tgid;
+    event->ns_pid = current_ns_pid();
+    bpf_get_current_comm(event->comm, sizeof(event->comm));
+    event->protocol = protocol;
+    event->direction = direction;
+    return event;
+}
+
+// emit_tcp_dns copies size bytes of a TCP DNS stream out of a user buffer.
+// Only the first DNS_MAX_LEN are kept, userspace knows from size how many
+// were left out.
+static __always_inline void emit_tcp_dns(struct conn_tuple *tuple, __u8 direction, void *buf, __u64 size) {
+    struct dns_event *event;
+    __u32 len = size;
+
+    if (!size || !buf)
+        return;
+    if (len > DNS_MAX_LEN)
+        len = DNS_MAX_LEN;
+
+    event = reserve_dns(PROTO_TCP, direction);
+    if (!event)
+        return;
+    event->tuple = *tuple;
+    event->size = size;
+    event->len = len;
+    if (bpf_probe_read_user(event->payload, len, buf) < 0) {
+        bpf_ringbuf_discard(event, 0);
+        return;
+    }
+    bpf_ringbuf_submit(event, 0);
+}
+
 SEC("kprobe/tcp_sendmsg")
 int trace_tcp_sendmsg(struct pt_regs *ctx)
 {
     struct sock *sk = (struct sock *)PT_REGS_PARM1(ctx);
-    size_t size = (size_t)PT_REGS_PARM3(ctx);
+    struct iovec segs[DNS_TCP_SEGMENTS] = {};
     struct conn_state *state;
-    struct inet_sock *inet = (struct inet_sock *)sk;
+    struct conn_tuple tuple;
+    int n;
     
-    __u32 saddr, daddr;
-    __u16 sport, dport;
-    
-    BPF_CORE_READ_INTO(&saddr, inet, inet_saddr);
-    BPF_CORE_READ_INTO(&daddr, inet, inet_daddr);
-    BPF_CORE_READ_INTO(&sport, inet, inet_sport);
-    BPF_CORE_READ_INTO(&dport, inet, inet_dport);
+    read_conn_tuple(sk, &tuple);
 
-    __u32 conn_key = make_conn_key(saddr, daddr, sport, dport);
-    state = bpf_map_lookup_elem(&conn_state_map, &conn_key);
-    
+    state = bpf_map_lookup_elem(&conn_state_map, &tuple);
     if (state) {
-        state->bytes_sent += size;
-        bpf_map_update_elem(&conn_state_map, &conn_key, state, BPF_EXIST);
+        read_bytes(sk, &state->bytes_sent, &state->bytes_received);
+        mark_active(sk, &tuple, state);
+    }
+
+    if (is_dns(&tuple)) {
+        n = read_iovecs((struct msghdr *)PT_REGS_PARM2(ctx), segs);
+        if (n > 0)
+            emit_tcp_dns(&tuple, DIR_OUTBOUND, segs[0].iov_base, segs[0].iov_len);
+        if (n > 1)
+            emit_tcp_dns(&tuple, DIR_OUTBOUND, segs[1].iov_base, segs[1].iov_len);
     }
 
     return 0;
@@ -249,104 +944,416 @@ SEC("kprobe/tcp_recvmsg")
 int trace_tcp_recvmsg(struct pt_regs *ctx)
 {
     struct sock *sk = (struct sock *)PT_REGS_PARM1(ctx);
-    size_t size = (size_t)PT_REGS_PARM3(ctx);
+    struct iovec segs[DNS_TCP_SEGMENTS] = {};
     struct conn_state *state;
-    struct inet_sock *inet = (struct inet_sock *)sk;
-    
-    __u32 saddr, daddr;
-    __u16 sport, dport;
+    struct conn_tuple tuple;
     
-    BPF_CORE_READ_INTO(&saddr, inet, inet_saddr);
-    BPF_CORE_READ_INTO(&daddr, inet, inet_daddr);
-    BPF_CORE_READ_INTO(&sport, inet, inet_sport);
-    BPF_CORE_READ_INTO(&dport, inet, inet_dport);
+    read_conn_tuple(sk, &tuple);
 
-    __u32 conn_key = make_conn_key(saddr, daddr, sport, dport);
-    state = bpf_map_lookup_elem(&conn_state_map, &conn_key);
-    
+    state = bpf_map_lookup_elem(&conn_state_map, &tuple);
     if (state) {
-        state->bytes_received += size;
-        bpf_map_update_elem(&conn_state_map, &conn_key, state, BPF_EXIST);
+        read_bytes(sk, &state->bytes_sent, &state->bytes_received);
+        mark_active(sk, &tuple, state);
+    }
+
+    // The data is only there on return, remember where it goes
+    if (is_dns(&tuple) && read_iovecs((struct msghdr *)PT_REGS_PARM2(ctx), segs) > 0) {
+        __u64 pid_tgid = bpf_get_current_pid_tgid();
+        struct dns_args args = {};
+
+        args.tuple = tuple;
+        args.buf = segs[0].iov_base;
+        args.buf_len = segs[0].iov_len;
+        bpf_map_update_elem(&dns_args_map, &pid_tgid, &args, BPF_ANY);
     }
 
     return 0;
 }
 
+// Reports what a read on a DNS connection returned. Bytes that went past
+// the first buffer count towards size but are not copied.
+SEC("kretprobe/tcp_recvmsg")
+int trace_tcp_recvmsg_ret(struct pt_regs *ctx)
+{
+    __u64 pid_tgid = bpf_get_current_pid_tgid();
+    int copied = (int)PT_REGS_RC(ctx);
+    struct dns_event *event;
+    struct dns_args *args;
+    __u32 len;
+
+    args = bpf_map_lookup_elem(&dns_args_map, &pid_tgid);
+    if (!args)
+        return 0;
+    if (copied <= 0)
+        goto out;
+
+    len = copied;
+    if (len > args->buf_len)
+        len = args->buf_len;
+    if (len > DNS_MAX_LEN)
+        len = DNS_MAX_LEN;
+
+    event = reserve_dns(PROTO_TCP, DIR_INBOUND);
+    if (!event)
+        goto out;
+    event->tuple = args->tuple;
+    event->size = copied;
+    event->len = len;
+    if (bpf_probe_read_user(event->payload, len, args->buf) < 0) {
+        bpf_ringbuf_discard(event, 0);
+        goto out;
+    }
+    bpf_ringbuf_submit(event, 0);
+
+out:
+    bpf_map_delete_elem(&dns_args_map, &pid_tgid);
+    return 0;
+}
+
+// The peer reset us.
 SEC("kprobe/tcp_reset")
 int trace_tcp_reset(struct pt_regs *ctx)
 {
-    struct sock *sk = (struct sock *)PT_REGS_PARM1(ctx);
+    return emit_reset((struct sock *)PT_REGS_PARM1(ctx), RESET_REMOTE);
+}
+
+// We reset the peer on a live connection (abort, close with unread data,
+// SO_LINGER with a zero timeout).
+SEC("kprobe/tcp_send_active_reset")
+int trace_tcp_send_active_reset(struct pt_regs *ctx)
+{
+    return emit_reset((struct sock *)PT_REGS_PARM1(ctx), RESET_LOCAL);
+}
+
+// We answered a segment with a reset. sk is NULL when no socket matched.
+SEC("tracepoint/tcp/tcp_send_reset")
+int trace_tcp_send_reset(struct trace_event_raw_tcp_event_sk_skb *ctx)
+{
+    return emit_reset((struct sock *)ctx->skaddr, RESET_LOCAL);
+}
+
+// Retransmissions or keepalive probes ran out, the connection timed out.
+SEC("kprobe/tcp_write_err")
+int trace_tcp_write_err(struct pt_regs *ctx)
+{
+    return emit_reset((struct sock *)PT_REGS_PARM1(ctx), RESET_TIMEOUT);
+}
+
+// read_msg_peer overrides the peer of a tuple with the address passed to
+// sendto or filled in by recvfrom, unconnected UDP sockets have none.
+static __always_inline void read_msg_peer(struct msghdr *msg, struct conn_tuple *t) {
+    void *name = NULL;
+    __u16 family = 0;
+
+    BPF_CORE_READ_INTO(&name, msg, msg_name);
+    if (!name)
+        return;
+
+    bpf_probe_read_kernel(&family, sizeof(family), name);
+    if (family == AF_INET) {
+        struct sockaddr_in sin = {};
+
+        bpf_probe_read_kernel(&sin, sizeof(sin), name);
+        // An IPv6 socket may talk to an IPv4 peer, its local address does not fit
+        if (t->family != AF_INET)
+            __builtin_memset(t->saddr, 0, sizeof(t->saddr));
+        __builtin_memset(t->daddr, 0, sizeof(t->daddr));
+        t->family = AF_INET;
+        t->daddr[0] = sin.sin_addr.s_addr;
+        t->dport = bpf_ntohs(sin.sin_port);
+    } else if (family == AF_INET6) {
+        struct sockaddr_in6 sin6 = {};
+
+        bpf_probe_read_kernel(&sin6, sizeof(sin6), name);
+        t->family = AF_INET6;
+        __builtin_memcpy(t->daddr, sin6.sin6_addr.in6_u.u6_addr32, sizeof(t->daddr));
+        t->dport = bpf_ntohs(sin6.sin6_port);
+    }
+}
+
+static __always_inline int stash_udp_args(struct pt_regs *ctx) {
+    __u64 pid_tgid = bpf_get_current_pid_tgid();
+    struct udp_args args = {};
+
+    args.sk = (struct sock *)PT_REGS_PARM1(ctx);
+    args.msg = (struct msghdr *)PT_REGS_PARM2(ctx);
+    bpf_map_update_elem(&udp_args_map, &pid_tgid, &args, BPF_ANY);
+    return 0;
+}
+
+// record_udp adds a datagram to its flow, reporting the flow when it is new.
+// The tuple is read on return, when the source port is bound and recvfrom
+// has filled in the peer.
+static __always_inline int record_udp(struct pt_regs *ctx, __u8 direction) {
+    __u64 pid_tgid = bpf_get_current_pid_tgid();
+    int copied = (int)PT_REGS_RC(ctx);
     struct conn_event *event;
-    struct conn_state *state;
-    
-    event = bpf_ringbuf_reserve(&events, sizeof(*event), 0);
+    struct udp_flow *flow;
+    struct udp_args *args;
+    struct conn_tuple tuple;
+    __u64 now;
+
+    args = bpf_map_lookup_elem(&udp_args_map, &pid_tgid);
+    if (!args)
+        return 0;
+    if (copied <= 0)
+        goto out;
+
+    read_conn_tuple(args->sk, &tuple);
+    read_msg_peer(args->msg, &tuple);
+    now = bpf_ktime_get_ns();
+
+    flow = bpf_map_lookup_elem(&udp_flow_map, &tuple);
+    if (!flow) {
+        struct udp_flow new_flow = {};
+
+        new_flow.start_time = now;
+        new_flow.pid = pid_tgid >> 32;
+        new_flow.direction = direction;
+        bpf_get_current_comm(new_flow.comm, sizeof(new_flow.comm));
+        new_flow.cgroup_id = bpf_get_current_cgroup_id();
+        new_flow.ns_pid = current_ns_pid();
+        if (bpf_map_update_elem(&udp_flow_map, &tuple, &new_flow, BPF_NOEXIST) == 0) {
+            event = reserve_event();
+            if (event) {
+                event->pid = pid_tgid >> 32;
+                event->tid = pid_tgid;
+                event->timestamp = now;
+                event->event_type = CONN_OPEN;
+                event->protocol = PROTO_UDP;
+                event->tuple = tuple;
+                event->direction = direction;
+                __builtin_memcpy(event->comm, new_flow.comm, sizeof(event->comm));
+                event->cgroup_id = new_flow.cgroup_id;
+                event->ns_pid = new_flow.ns_pid;
+                bpf_ringbuf_submit(event, 0);
+            }
+        }
+
+        flow = bpf_map_lookup_elem(&udp_flow_map, &tuple);
+        if (!flow)
+            goto out;
+    }
+
+    flow->last_activity = now;
+    if (direction == DIR_OUTBOUND)
+        __sync_fetch_and_add(&flow->bytes_sent, copied);
+    else
+        __sync_fetch_and_add(&flow->bytes_received, copied);
+
+out:
+    bpf_map_delete_elem(&udp_args_map, &pid_tgid);
+    return 0;
+}
+
+// Attached to both udp_sendmsg and udpv6_sendmsg. An IPv6 socket sending to
+// an IPv4 peer goes through both, the inner call replaces the stashed
+// arguments and the datagram is only counted once.
+SEC("kprobe/udp_sendmsg")
+int trace_udp_sendmsg(struct pt_regs *ctx)
+{
+    return stash_udp_args(ctx);
+}
+
+SEC("kretprobe/udp_sendmsg")
+int trace_udp_sendmsg_ret(struct pt_regs *ctx)
+{
+    return record_udp(ctx, DIR_OUTBOUND);
+}
+
+// Attached to both udp_recvmsg and udpv6_recvmsg.
+SEC("kprobe/udp_recvmsg")
+int trace_udp_recvmsg(struct pt_regs *ctx)
+{
+    return stash_udp_args(ctx);
+}
+
+SEC("kretprobe/udp_recvmsg")
+int trace_udp_recvmsg_ret(struct pt_regs *ctx)
+{
+    return record_udp(ctx, DIR_INBOUND);
+}
+
+// emit_dns copies a DNS message out of a UDP skb. Only the linear part of
+// the skb is read, DNS messages are small enough to always be there.
+// sk is the socket sending or receiving it.
+static __always_inline int emit_dns(struct sock *sk, struct sk_buff *skb, __u8 direction) {
+    __u16 transport_header = 0, network_header = 0;
+    unsigned char *head = NULL;
+    struct dns_event *event;
+    struct udphdr udp = {};
+    __u32 *src, *dst;
+    __u8 version = 0;
+    __u32 size, len;
+
+    BPF_CORE_READ_INTO(&head, skb, head);
+    BPF_CORE_READ_INTO(&transport_header, skb, transport_header);
+    BPF_CORE_READ_INTO(&network_header, skb, network_header);
+
+    bpf_probe_read_kernel(&udp, sizeof(udp), head + transport_header);
+    if (udp.source != bpf_htons(DNS_PORT) && udp.dest != bpf_htons(DNS_PORT))
+        return 0;
+
+    size = bpf_ntohs(udp.len);
+    if (size <= sizeof(udp))
+        return 0;
+    size -= sizeof(udp);
+    len = size;
+    if (len > DNS_MAX_LEN)
+        len = DNS_MAX_LEN;
+
+    event = reserve_dns(PROTO_UDP, direction);
     if (!event)
         return 0;
 
-    __u64 now = bpf_ktime_get_ns();
-    event->pid = bpf_get_current_pid_tgid() >> 32;
-    event->tid = bpf_get_current_pid_tgid();
-    event->timestamp = now;
-    event->event_type = CONN_RESET;
-    event->protocol = PROTO_TCP;
-    event->reset_reason = RESET_ABORT;
+    event->size = size;
+    event->len = len;
+    event->tuple.netns = read_netns(sk);
 
-    struct inet_sock *inet = (struct inet_sock *)sk;
-    BPF_CORE_READ_INTO(&event->saddr, inet, inet_saddr);
-    BPF_CORE_READ_INTO(&event->daddr, inet, inet_daddr);
-    BPF_CORE_READ_INTO(&event->sport, inet, inet_sport);
-    BPF_CORE_READ_INTO(&event->dport, inet, inet_dport);
+    // Headers are in wire order, the source is local when sending
+    src = direction == DIR_OUTBOUND ? event->tuple.saddr : event->tuple.daddr;
+    dst = direction == DIR_OUTBOUND ? event->tuple.daddr : event->tuple.saddr;
+    bpf_probe_read_kernel(&version, sizeof(version), head + network_header);
+    if (version >> 4 == 6) {
+        event->tuple.family = AF_INET6;
+        bpf_probe_read_kernel(src, 16, head + network_header + IPV6_SADDR_OFF);
+        bpf_probe_read_kernel(dst, 16, head + network_header + IPV6_DADDR_OFF);
+    } else {
+        event->tuple.family = AF_INET;
+        bpf_probe_read_kernel(src, 4, head + network_header + IPV4_SADDR_OFF);
+        bpf_probe_read_kernel(dst, 4, head + network_header + IPV4_DADDR_OFF);
+    }
 
-    __u32 conn_key = make_conn_key(event->saddr, event->daddr, event->sport, event->dport);
-    
-    state = bpf_map_lookup_elem(&conn_state_map, &conn_key);
-    if (state) {
-        event->duration_ms = (now - state->start_time) / 1000000;
-        event->bytes_sent = state->bytes_sent;
-        event->bytes_received = state->bytes_received;
-        event->rtt_us = state->last_rtt;
-        event->tcp_state = state->tcp_state;
-        
-        bpf_map_delete_elem(&conn_state_map, &conn_key);
+    if (direction == DIR_OUTBOUND) {
+        event->tuple.sport = bpf_ntohs(udp.source);
+        event->tuple.dport = bpf_ntohs(udp.dest);
     } else {
-        event->duration_ms = 0;
-        event->bytes_sent = 0;
-        event->bytes_received = 0;
-        event->rtt_us = 0;
-        event->tcp_state = 0;
+        event->tuple.sport = bpf_ntohs(udp.dest);
+        event->tuple.dport = bpf_ntohs(udp.source);
     }
 
+    bpf_probe_read_kernel(event->payload, len, head + transport_header + sizeof(udp));
+
     bpf_ringbuf_submit(event, 0);
     return 0;
 }
 
-SEC("kprobe/tcp_connect_fail")
-int trace_tcp_connect_fail(struct pt_regs *ctx)
+// Attached to both udp_send_skb and udp_v6_send_skb, the skb is complete.
+SEC("kprobe/udp_send_skb")
+int trace_udp_send_skb(struct pt_regs *ctx)
 {
-    struct sock *sk = (struct sock *)PT_REGS_PARM1(ctx);
+    struct sk_buff *skb = (struct sk_buff *)PT_REGS_PARM1(ctx);
+    struct sock *sk = NULL;
+
+    BPF_CORE_READ_INTO(&sk, skb, sk);
+    return emit_dns(sk, skb, DIR_OUTBOUND);
+}
+
+// Called by udp_recvmsg and udpv6_recvmsg in the receiving process.
+SEC("kprobe/skb_consume_udp")
+int trace_skb_consume_udp(struct pt_regs *ctx)
+{
+    return emit_dns((struct sock *)PT_REGS_PARM1(ctx), (struct sk_buff *)PT_REGS_PARM2(ctx), DIR_INBOUND);
+}
+
+// getaddrinfo(node, service, hints, res) in libc, attached per library.
+SEC("uprobe/getaddrinfo")
+int trace_getaddrinfo(struct pt_regs *ctx)
+{
+    __u64 pid_tgid = bpf_get_current_pid_tgid();
+    struct resolve_args args = {};
+
+    args.node = (const char *)PT_REGS_PARM1(ctx);
+    args.res = (struct user_addrinfo **)PT_REGS_PARM4(ctx);
+    if (!args.node)
+        return 0;
+
+    bpf_map_update_elem(&resolve_args_map, &pid_tgid, &args, BPF_ANY);
+    return 0;
+}
+
+SEC("uretprobe/getaddrinfo")
+int trace_getaddrinfo_ret(struct pt_regs *ctx)
+{
+    __u64 pid_tgid = bpf_get_current_pid_tgid();
+    struct user_addrinfo *ai = NULL;
+    struct resolve_event *event;
+    struct resolve_args *args;
+    __u32 count = 0;
+
+    args = bpf_map_lookup_elem(&resolve_args_map, &pid_tgid);
+    if (!args)
+        return 0;
+    if ((int)PT_REGS_RC(ctx) != 0)
+        goto out;
+
+    bpf_probe_read_user(&ai, sizeof(ai), args->res);
+    if (!ai)
+        goto out;
+
+    event = bpf_ringbuf_reserve(&resolve_events, sizeof(*event), 0);
+    if (!event)
+        goto out;
+    __builtin_memset(event, 0, sizeof(*event));
+
+    event->timestamp = bpf_ktime_get_ns();
+    event->pid = pid_tgid >> 32;
+    bpf_probe_read_user_str(event->hostname, sizeof(event->hostname), args->node);
+
+#pragma unroll
+    for (int i = 0; i < RESOLVE_MAX_ENTRIES; i++) {
+        struct user_addrinfo info = {};
+
+        if (!ai || count >= RESOLVE_MAX_ADDRS)
+            break;
+        bpf_probe_read_user(&info, sizeof(info), ai);
+
+        if (info.ai_family == AF_INET) {
+            struct sockaddr_in sin = {};
+
+            bpf_probe_read_user(&sin, sizeof(sin), info.ai_addr);
+            event->family[count] = AF_INET;
+            event->addrs[count][0] = sin.sin_addr.s_addr;
+            count++;
+        } else if (info.ai_family == AF_INET6) {
+            struct sockaddr_in6 sin6 = {};
+
+            bpf_probe_read_user(&sin6, sizeof(sin6), info.ai_addr);
+            event->family[count] = AF_INET6;
+            __builtin_memcpy(event->addrs[count], sin6.sin6_addr.in6_u.u6_addr32, 16);
+            count++;
+        }
+        ai = info.ai_next;
+    }
+    event->count = count;
+
+    bpf_ringbuf_submit(event, 0);
+
+out:
+    bpf_map_delete_elem(&resolve_args_map, &pid_tgid);
+    return 0;
+}
+
+// Process exits let userspace drop what it cached about a PID before the
+// PID is reused. Threads exiting are not interesting, only the group leader.
+SEC("tracepoint/sched/sched_process_exit")
+int trace_sched_process_exit(void *ctx)
+{
+    __u64 pid_tgid = bpf_get_current_pid_tgid();
     struct conn_event *event;
-    
-    event = bpf_ringbuf_reserve(&events, sizeof(*event), 0);
+
+    if ((__u32)pid_tgid != pid_tgid >> 32)
+        return 0;
+
+    event = reserve_event();
     if (!event)
         return 0;
 
-    event->pid = bpf_get_current_pid_tgid() >> 32;
-    event->tid = bpf_get_current_pid_tgid();
+    event->pid = pid_tgid >> 32;
+    event->tid = pid_tgid;
     event->timestamp = bpf_ktime_get_ns();
-    event->event_type = CONN_FAILED;
-    event->protocol = PROTO_TCP;
-    event->reset_reason = RESET_REFUSED;
-    event->duration_ms = 0;
-    event->bytes_sent = 0;
-    event->bytes_received = 0;
-    event->rtt_us = 0;
-    event->tcp_state = 0;
-
-    struct inet_sock *inet = (struct inet_sock *)sk;
-    BPF_CORE_READ_INTO(&event->saddr, inet, inet_saddr);
-    BPF_CORE_READ_INTO(&event->daddr, inet, inet_daddr);
-    BPF_CORE_READ_INTO(&event->sport, inet, inet_sport);
-    BPF_CORE_READ_INTO(&event->dport, inet, inet_dport);
+    event->event_type = PROC_EXIT;
+    bpf_get_current_comm(event->comm, sizeof(event->comm));
 
     bpf_ringbuf_submit(event, 0);
     return 0;
@@ -3,16 +3,27 @@
 #include "vmlinux.h"
 #include <bpf/bpf_helpers.h>
 #include <bpf/bpf_core_read.h>
+#include <bpf/bpf_endian.h>
 
 #define MAX_ENTRIES 10240
 
+#define AF_INET 2
+#define AF_INET6 10
+
+// Must stay layout-compatible with conn_tracker.c, both share one decoder.
+struct conn_tuple {
+    __u32 saddr[4];
+    __u32 daddr[4];
+    __u16 sport;
+    __u16 dport;
+    __u16 family;
+    __u32 netns;
+};
+
 struct conn_event {
     __u32 pid;
     __u32 tid;
-    __u32 saddr;
-    __u32 daddr;
-    __u16 sport;
-    __u16 dport;
+    struct conn_tuple tuple;
     __u8 event_type;
     __u8 protocol;
     __u64 timestamp;
@@ -22,6 +33,18 @@ struct conn_event {
     __u32 duration_ms;
     __u8 tcp_state;
     __u8 reset_reason;
+    __u8 direction;
+    __u8 prev_tcp_state;
+    __u32 rtt_var_us;
+    __u32 retransmits;
+    __u16 rto_count;
+    __u16 tlp_count;
+    __u16 sk_err;
+    __u8 idle;
+    __u32 connect_us;
+    char comm[16];
+    __u64 cgroup_id;
+    __u32 ns_pid;
 };
 
 enum event_type {
@@ -33,77 +56,132 @@ enum event_type {
     CONN_DATA = 6,
 };
 
+enum direction {
+    DIR_UNKNOWN = 0,
+    DIR_OUTBOUND = 1,
+    DIR_INBOUND = 2,
+};
+
 enum protocol_type {
     PROTO_TCP = 6,
     PROTO_UDP = 17,
     PROTO_UNKNOWN = 0,
 };
 
+// Start of the connections seen in tcp_connect, so only those are
+// reported closed.
+struct conn_start {
+    __u64 start_time;
+    __u32 pid;
+    __u32 tid;
+};
+
 struct {
     __uint(type, BPF_MAP_TYPE_RINGBUF);
     __uint(max_entries, 256 * 1024);
 } events SEC(".maps");
 
-SEC("kprobe/sys_connect")
-int trace_connect_entry(struct pt_regs *ctx)
+struct {
+    __uint(type, BPF_MAP_TYPE_LRU_HASH);
+    __type(key, struct conn_tuple);
+    __type(value, struct conn_start);
+    __uint(max_entries, MAX_ENTRIES);
+} conn_start_map SEC(".maps");
+
+static __always_inline void read_conn_tuple(struct sock *sk, struct conn_tuple *t) {
+    struct net *net = NULL;
+
+    // Zero the padding too, the tuple is used as a hash map key.
+    __builtin_memset(t, 0, sizeof(*t));
+    BPF_CORE_READ_INTO(&t->family, sk, __sk_common.skc_family);
+    BPF_CORE_READ_INTO(&t->sport, sk, __sk_common.skc_num);
+    BPF_CORE_READ_INTO(&t->dport, sk, __sk_common.skc_dport);
+    t->dport = bpf_ntohs(t->dport);
+    BPF_CORE_READ_INTO(&net, sk, __sk_common.skc_net.net);
+    BPF_CORE_READ_INTO(&t->netns, net, ns.inum);
+
+    if (t->family == AF_INET6) {
+        BPF_CORE_READ_INTO(&t->saddr, sk, __sk_common.skc_v6_rcv_saddr.in6_u.u6_addr32);
+        BPF_CORE_READ_INTO(&t->daddr, sk, __sk_common.skc_v6_daddr.in6_u.u6_addr32);
+    } else {
+        BPF_CORE_READ_INTO(&t->saddr[0], sk, __sk_common.skc_rcv_saddr);
+        BPF_CORE_READ_INTO(&t->daddr[0], sk, __sk_common.skc_daddr);
+    }
+}
+
+// The reduced program set for kernels the full one does not load on: the
+// outbound TCP connections a process opens and closes, without traffic,
+// RTT or state details.
+SEC("kprobe/tcp_connect")
+int trace_tcp_connect(struct pt_regs *ctx)
 {
+    struct sock *sk = (struct sock *)PT_REGS_PARM1(ctx);
+    __u64 pid_tgid = bpf_get_current_pid_tgid();
+    struct conn_start start = {};
     struct conn_event *event;
-    
+    struct conn_tuple tuple;
+
+    read_conn_tuple(sk, &tuple);
+    start.start_time = bpf_ktime_get_ns();
+    start.pid = pid_tgid >> 32;
+    start.tid = pid_tgid;
+    bpf_map_update_elem(&conn_start_map, &tuple, &start, BPF_ANY);
+
     event = bpf_ringbuf_reserve(&events, sizeof(*event), 0);
     if (!event)
         return 0;
+    __builtin_memset(event, 0, sizeof(*event));
 
-    event->pid = bpf_get_current_pid_tgid() >> 32;
-    event->tid = bpf_get_current_pid_tgid();
-    event->timestamp = bpf_ktime_get_ns();
+    event->pid = start.pid;
+    event->tid = start.tid;
+    event->timestamp = start.start_time;
     event->event_type = CONN_OPEN;
     event->protocol = PROTO_TCP;
-    event->bytes_sent = 0;
-    event->bytes_received = 0;
-    event->rtt_us = 0;
-    event->duration_ms = 0;
-    event->tcp_state = 1;
-    event->reset_reason = 0;
-    
-    // For demo purposes, use placeholder values
-    event->saddr = 0x0100007f; // 127.0.0.1
-    event->daddr = 0x0100007f; // 127.0.0.1
-    event->sport = 8080;
-    event->dport = 80;
+    event->tuple = tuple;
+    event->tcp_state = TCP_SYN_SENT;
+    event->direction = DIR_OUTBOUND;
+    bpf_get_current_comm(event->comm, sizeof(event->comm));
+    event->cgroup_id = bpf_get_current_cgroup_id();
 
     bpf_ringbuf_submit(event, 0);
     return 0;
 }
 
-SEC("kprobe/sys_close")
-int trace_close_entry(struct pt_regs *ctx)
+SEC("kprobe/tcp_close")
+int trace_tcp_close(struct pt_regs *ctx)
 {
+    struct sock *sk = (struct sock *)PT_REGS_PARM1(ctx);
+    struct conn_start *start;
     struct conn_event *event;
-    
-    event = bpf_ringbuf_reserve(&events, sizeof(*event), 0);
-    if (!event)
+    struct conn_tuple tuple;
+    __u64 now;
+
+    read_conn_tuple(sk, &tuple);
+    start = bpf_map_lookup_elem(&conn_start_map, &tuple);
+    if (!start)
         return 0;
 
-    event->pid = bpf_get_current_pid_tgid() >> 32;
-    event->tid = bpf_get_current_pid_tgid();
-    event->timestamp = bpf_ktime_get_ns();
-    event->event_type = CONN_CLOSE;
-    event->protocol = PROTO_TCP;
-    event->bytes_sent = 1024;
-    event->bytes_received = 2048;
-    event->rtt_us = 500;
-    event->duration_ms = 5000;
-    event->tcp_state = 0;
-    event->reset_reason = 0;
-    
-    // For demo purposes, use placeholder values
-    event->saddr = 0x0100007f; // 127.0.0.1
-    event->daddr = 0x0100007f; // 127.0.0.1
-    event->sport = 8080;
-    event->dport = 80;
+    event = bpf_ringbuf_reserve(&events, sizeof(*event), 0);
+    if (event) {
+        __builtin_memset(event, 0, sizeof(*event));
 
-    bpf_ringbuf_submit(event, 0);
+        now = bpf_ktime_get_ns();
+        event->pid = start->pid;
+        event->tid = start->tid;
+        event->timestamp = now;
+        event->event_type = CONN_CLOSE;
+        event->protocol = PROTO_TCP;
+        event->tuple = tuple;
+        event->duration_ms = (now - start->start_time) / 1000000;
+        event->tcp_state = BPF_CORE_READ(sk, __sk_common.skc_state);
+        event->direction = DIR_OUTBOUND;
+        bpf_get_current_comm(event->comm, sizeof(event->comm));
+        event->cgroup_id = bpf_get_current_cgroup_id();
+        bpf_ringbuf_submit(event, 0);
+    }
+
+    bpf_map_delete_elem(&conn_start_map, &tuple);
     return 0;
 }
 
-char _license[] SEC("license") = "GPL";
\ No newline at end of file
+char _license[] SEC("license") = "GPL";
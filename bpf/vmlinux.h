@@ -21,6 +21,9 @@ typedef __u32 __wsum;
 // BPF map types
 enum bpf_map_type {
     BPF_MAP_TYPE_HASH = 1,
+    BPF_MAP_TYPE_ARRAY = 2,
+    BPF_MAP_TYPE_PERCPU_HASH = 5,
+    BPF_MAP_TYPE_LRU_HASH = 9,
     BPF_MAP_TYPE_RINGBUF = 27,
 };
 
@@ -31,7 +34,139 @@ enum {
     BPF_EXIST = 2,
 };
 
+enum {
+    IPPROTO_TCP = 6,
+    IPPROTO_UDP = 17,
+};
+
+enum {
+    TCP_ESTABLISHED = 1,
+    TCP_SYN_SENT = 2,
+    TCP_SYN_RECV = 3,
+    TCP_FIN_WAIT1 = 4,
+    TCP_FIN_WAIT2 = 5,
+    TCP_TIME_WAIT = 6,
+    TCP_CLOSE = 7,
+    TCP_CLOSE_WAIT = 8,
+    TCP_LAST_ACK = 9,
+    TCP_LISTEN = 10,
+    TCP_CLOSING = 11,
+    TCP_NEW_SYN_RECV = 12,
+};
+
+// Kinds of iov_iter. The values differ between kernels and are relocated,
+// ITER_UBUF only exists since 6.0.
+enum iter_type {
+    ITER_UBUF = 0,
+    ITER_IOVEC = 1,
+};
+
+#pragma clang attribute push (__attribute__((preserve_access_index)), apply_to = record)
+
+struct in6_addr {
+    union {
+        __u8 u6_addr8[16];
+        __be16 u6_addr16[8];
+        __be32 u6_addr32[4];
+    } in6_u;
+};
+
+struct in_addr {
+    __be32 s_addr;
+};
+
+struct sockaddr_in {
+    unsigned short sin_family;
+    __be16 sin_port;
+    struct in_addr sin_addr;
+    unsigned char __pad[8];
+};
+
+struct sockaddr_in6 {
+    unsigned short sin6_family;
+    __be16 sin6_port;
+    __be32 sin6_flowinfo;
+    struct in6_addr sin6_addr;
+    __u32 sin6_scope_id;
+};
+
+struct iovec {
+    void *iov_base;
+    unsigned long iov_len;
+};
+
+// Since 6.4 the iovec array is __iov, the user buffer of a single-segment
+// read or write ubuf.
+struct iov_iter {
+    __u8 iter_type;
+    unsigned long iov_offset;
+    unsigned long count;
+    union {
+        const struct iovec *__iov;
+        void *ubuf;
+    };
+};
+
+// Before 6.4 the iovec array was iov.
+struct iov_iter___old {
+    const struct iovec *iov;
+};
+
+struct msghdr {
+    void *msg_name;
+    int msg_namelen;
+    struct iov_iter msg_iter;
+};
+
+struct upid {
+    int nr;
+    void *ns;
+};
+
+struct pid {
+    unsigned int level;
+    struct upid numbers[1];
+};
+
+struct task_struct {
+    struct task_struct *group_leader;
+    struct pid *thread_pid;
+};
+
+struct ns_common {
+    unsigned int inum;
+};
+
+struct net {
+    struct ns_common ns;
+};
+
+typedef struct {
+    struct net *net;
+} possible_net_t;
+
+struct sock_common {
+    __be32 skc_daddr;
+    __be32 skc_rcv_saddr;
+    __be16 skc_dport;
+    __u16 skc_num;
+    unsigned short skc_family;
+    volatile unsigned char skc_state;
+    struct in6_addr skc_v6_daddr;
+    struct in6_addr skc_v6_rcv_saddr;
+    possible_net_t skc_net;
+};
+
+struct timer_list {
+    void *entry[2];
+    unsigned long expires;
+};
+
 struct sock {
+    struct sock_common __sk_common;
+    int sk_err;
+    int sk_err_soft;
+    struct timer_list sk_timer;
     void *__placeholder[64];
 };
 
@@ -43,6 +178,67 @@ struct inet_sock {
     void *__placeholder[32];
 };
 
+struct tcp_sock {
+    __u32 srtt_us;
+    __u32 mdev_us;
+    __u64 bytes_received;
+    __u64 bytes_acked;
+};
+
+struct sk_buff {
+    struct sock *sk;
+    unsigned char *head;
+    __u16 transport_header;
+    __u16 network_header;
+};
+
+struct udphdr {
+    __be16 source;
+    __be16 dest;
+    __be16 len;
+    __u16 check;
+};
+
+struct trace_entry {
+    unsigned short type;
+    unsigned char flags;
+    unsigned char preempt_count;
+    int pid;
+};
+
+struct trace_event_raw_inet_sock_set_state {
+    struct trace_entry ent;
+    const void *skaddr;
+    int oldstate;
+    int newstate;
+    __u16 sport;
+    __u16 dport;
+    __u16 family;
+    __u16 protocol;
+    __u8 saddr[4];
+    __u8 daddr[4];
+    __u8 saddr_v6[16];
+    __u8 daddr_v6[16];
+    char __data[0];
+};
+
+struct trace_event_raw_tcp_event_sk_skb {
+    struct trace_entry ent;
+    const void *skbaddr;
+    const void *skaddr;
+    int state;
+    __u16 sport;
+    __u16 dport;
+    __u16 family;
+    __u8 saddr[4];
+    __u8 daddr[4];
+    __u8 saddr_v6[16];
+    __u8 daddr_v6[16];
+    char __data[0];
+};
+
+#pragma clang attribute pop
+
 #ifdef __TARGET_ARCH_arm64
 struct pt_regs {
     __u64 regs[31];
@@ -53,13 +249,19 @@ struct pt_regs {
 #define PT_REGS_PARM1(x) ((x)->regs[0])
 #define PT_REGS_PARM2(x) ((x)->regs[1])
 #define PT_REGS_PARM3(x) ((x)->regs[2])
+#define PT_REGS_PARM4(x) ((x)->regs[3])
+#define PT_REGS_RC(x) ((x)->regs[0])
 #else
+// x86_64 layout: r15 r14 r13 r12 bp bx r11 r10 r9 r8 ax cx dx si di orig_ax
+// ip cs flags sp ss
 struct pt_regs {
-    unsigned long long regs[16];
+    unsigned long long regs[21];
 };
-#define PT_REGS_PARM1(x) ((x)->regs[7])
-#define PT_REGS_PARM2(x) ((x)->regs[6])
-#define PT_REGS_PARM3(x) ((x)->regs[5])
+#define PT_REGS_PARM1(x) ((x)->regs[14])
+#define PT_REGS_PARM2(x) ((x)->regs[13])
+#define PT_REGS_PARM3(x) ((x)->regs[12])
+#define PT_REGS_PARM4(x) ((x)->regs[11])
+#define PT_REGS_RC(x) ((x)->regs[10])
 #endif
 
 #endif /* _VMLINUX_H_ */
\ No newline at end of file
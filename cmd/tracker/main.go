@@ -11,7 +11,10 @@ import (
 
 	"github.com/pedrospdc/gespann/internal/adapters"
 	"github.com/pedrospdc/gespann/internal/config"
+	"github.com/pedrospdc/gespann/internal/dns"
 	"github.com/pedrospdc/gespann/internal/ebpf"
+	"github.com/pedrospdc/gespann/internal/enrich"
+	"github.com/pedrospdc/gespann/internal/kubernetes"
 	"github.com/pedrospdc/gespann/internal/metrics"
 	"github.com/pedrospdc/gespann/pkg/types"
 )
@@ -71,7 +74,7 @@ func main() {
 		}
 	}()
 
-	tracker, err := ebpf.NewTracker(logger)
+	tracker, err := ebpf.NewTracker(cfg.Tracker, logger)
 	if err != nil {
 		logger.Error("failed to create eBPF tracker", "error", err)
 		os.Exit(1)
@@ -89,6 +92,9 @@ func main() {
 		logger.Error("failed to start eBPF tracker", "error", err)
 		os.Exit(1)
 	}
+	caps := tracker.Capabilities()
+	collector.SetProgram(types.TrackerProgram{Requested: caps.Requested, Program: caps.Program})
+	collector.SetProbeStatus(caps.Probes)
 
 	eventCh := make(chan types.ConnEvent, 1000)
 
@@ -99,14 +105,86 @@ func main() {
 		}
 	}()
 
+	dnsCache := dns.NewCache()
+	dnsMonitor := dns.NewMonitor(dnsCache, logger)
+	dnsPacketCh := make(chan types.DNSPacket, 1000)
+	dnsEventCh := make(chan types.DNSEvent, 1000)
+
+	go func() {
+		if err := tracker.ReadDNS(ctx, dnsPacketCh); err != nil && ctx.Err() == nil {
+			logger.Error("error reading DNS events", "error", err)
+		}
+	}()
+
+	go dnsMonitor.Run(ctx, dnsPacketCh, dnsEventCh)
+
+	resolutionCh := make(chan types.Resolution, 1000)
+
+	go func() {
+		if err := tracker.ReadResolutions(ctx, resolutionCh); err != nil && ctx.Err() == nil {
+			logger.Error("error reading resolutions", "error", err)
+		}
+	}()
+
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case resolution := <-resolutionCh:
+				dnsCache.AddResolution(resolution)
+			}
+		}
+	}()
+
 	go func() {
-		for event := range eventCh {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case event := <-dnsEventCh:
+				collector.ProcessDNSEvent(event)
+			}
+		}
+	}()
+
+	// Kubernetes metadata is looked up from the cgroup, which must be resolved first
+	annotators := []enrich.Annotator{enrich.NewCgroups(logger), dnsCache}
+	if cfg.Kubernetes.Enabled {
+		kubeCache, err := kubernetes.NewCache(cfg.Kubernetes, logger)
+		if err != nil {
+			logger.Error("failed to create Kubernetes client", "error", err)
+			os.Exit(1)
+		}
+		go kubeCache.Run(ctx)
+		annotators = append(annotators, kubeCache)
+		logger.Info("Kubernetes metadata enabled")
+	}
+
+	enrichedCh := make(chan types.ConnEvent, 1000)
+	stage := enrich.NewStage(enrich.NewProcesses(), annotators...)
+
+	go stage.Run(ctx, eventCh, enrichedCh)
+
+	go func() {
+		for event := range enrichedCh {
 			collector.ProcessEvent(event)
 		}
 	}()
 
+	// Only the full program set tracks connections and counts TCP states
+	// in the kernel
+	full := tracker.Capabilities().Program == ebpf.ProgramFull
+	if full {
+		collector.SetTCPStateSource(tracker)
+	}
+
 	go collector.Start(ctx, 10*time.Second)
 
+	if full {
+		go collector.Reconcile(ctx, tracker, cfg.Tracker.ReconcileInterval)
+	}
+
 	logger.Info("gespann started successfully")
 
 	sigCh := make(chan os.Signal, 1)
@@ -114,7 +192,7 @@ func main() {
 
 	<-sigCh
 	logger.Info("shutting down...")
+	// eventCh is left open, the tracker's goroutines may still be sending.
+	// The enrichment stage stops on ctx.
 	cancel()
-
-	close(eventCh)
 }
@@ -2,6 +2,11 @@ package adapters
 
 import (
 	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"path/filepath"
+	"strconv"
 
 	"github.com/pedrospdc/gespann/pkg/types"
 )
@@ -9,6 +14,7 @@ import (
 type MetricsAdapter interface {
 	SendMetrics(ctx context.Context, metrics types.ConnMetrics) error
 	SendEvent(ctx context.Context, event types.ConnEvent) error
+	SendDNSEvent(ctx context.Context, event types.DNSEvent) error
 	Close() error
 }
 
@@ -27,3 +33,262 @@ func NewAdapter(config Config) (MetricsAdapter, error) {
 		return NewNoOpAdapter(), nil
 	}
 }
+
+// addrFamily returns the label value for an address family. IPv4-mapped IPv6
+// addresses from dual-stack sockets count as IPv4.
+func addrFamily(addr netip.Addr) string {
+	switch {
+	case addr.Unmap().Is4():
+		return "ipv4"
+	case addr.Is6():
+		return "ipv6"
+	default:
+		return "unknown"
+	}
+}
+
+// formatEndpoint renders an address and port as "1.2.3.4:80" or "[::1]:80",
+// unmapping IPv4-mapped IPv6 addresses.
+func formatEndpoint(addr netip.Addr, port uint16) string {
+	if !addr.IsValid() {
+		return "unknown:" + strconv.FormatUint(uint64(port), 10)
+	}
+	return netip.AddrPortFrom(addr.Unmap(), port).String()
+}
+
+// destination returns the server side endpoint of a connection: the remote
+// peer for outbound connections and the local listener for inbound ones.
+// Peers are named by the hostname they were resolved from when it is known.
+func destination(event types.ConnEvent) string {
+	if event.Direction == types.DirectionInbound {
+		return formatEndpoint(event.SAddr, event.SPort)
+	}
+	if event.DestinationName != "" {
+		return net.JoinHostPort(event.DestinationName, strconv.FormatUint(uint64(event.DPort), 10))
+	}
+	return formatEndpoint(event.DAddr, event.DPort)
+}
+
+// parsePIDSetting parses the "pid" adapter setting, which PID to report:
+// "host" (the default) or "namespaced", the PID inside the container.
+func parsePIDSetting(value string) (bool, error) {
+	switch value {
+	case "", "host":
+		return false, nil
+	case "namespaced":
+		return true, nil
+	default:
+		return false, fmt.Errorf("unknown pid setting %q, expected \"host\" or \"namespaced\"", value)
+	}
+}
+
+// eventPID returns the PID to report for an event given its host and
+// namespaced PIDs. Events without a namespaced PID report the host PID.
+func eventPID(pid, namespacedPID uint32, namespaced bool) string {
+	if namespaced && namespacedPID != 0 {
+		pid = namespacedPID
+	}
+	return strconv.FormatUint(uint64(pid), 10)
+}
+
+// netnsName returns the label value for a network namespace inode, empty
+// when it is not known.
+func netnsName(netns uint32) string {
+	if netns == 0 {
+		return ""
+	}
+	return strconv.FormatUint(uint64(netns), 10)
+}
+
+// processName returns the label value for the process owning a connection
+// or making a lookup: the executable name, or the kernel comm when /proc
+// could not be read.
+func processName(process types.ProcessInfo) string {
+	switch {
+	case process.Exe != "":
+		return filepath.Base(process.Exe)
+	case process.Comm != "":
+		return process.Comm
+	default:
+		return "unknown"
+	}
+}
+
+// podWorkload returns the namespace and workload of a pod, empty outside
+// Kubernetes.
+func podWorkload(pod *types.PodInfo) (string, string) {
+	if pod == nil {
+		return "", ""
+	}
+	return pod.Namespace, pod.Workload
+}
+
+// peerWorkload returns the namespace and workload of the remote end: the
+// workload of its pod, or the Service when it was reached by cluster IP.
+func peerWorkload(event types.ConnEvent) (string, string) {
+	if event.PeerPod != nil {
+		return podWorkload(event.PeerPod)
+	}
+	if event.PeerService != nil {
+		return event.PeerService.Namespace, event.PeerService.Name
+	}
+	return "", ""
+}
+
+// resetReasonName returns the label value for a reset reason. "local" means
+// we reset the peer, "remote" that the peer reset us.
+func resetReasonName(r types.ResetReason) string {
+	switch r {
+	case types.ResetNormal:
+		return "normal"
+	case types.ResetTimeout:
+		return "timeout"
+	case types.ResetRefused:
+		return "refused"
+	case types.ResetAbort:
+		return "abort"
+	case types.ResetLocal:
+		return "local"
+	case types.ResetRemote:
+		return "remote"
+	default:
+		return ""
+	}
+}
+
+// failureReasonName returns the label value for a failed connect. "timeout"
+// usually means SYNs were dropped, "aborted" that the application gave up
+// before the kernel did.
+func failureReasonName(r types.FailureReason) string {
+	switch r {
+	case types.FailureRefused:
+		return "refused"
+	case types.FailureTimeout:
+		return "timeout"
+	case types.FailureHostUnreachable:
+		return "host_unreachable"
+	case types.FailureNetUnreachable:
+		return "net_unreachable"
+	case types.FailureAborted:
+		return "aborted"
+	case types.FailureOther:
+		return "other"
+	default:
+		return ""
+	}
+}
+
+// connectResult returns the outcome label for an event carrying handshake
+// latency: "established" or the failure reason.
+func connectResult(event types.ConnEvent) string {
+	if event.Type == types.ConnFailed {
+		return failureReasonName(event.FailureReason)
+	}
+	return "established"
+}
+
+// reportsTraffic reports whether an event carries traffic not counted yet:
+// CONN_DATA deltas and the remainder on close or reset.
+func reportsTraffic(event types.ConnEvent) bool {
+	return event.Type == types.ConnData || event.Type == types.ConnClose || event.Type == types.ConnReset
+}
+
+// dnsTypeName returns the label value for a DNS query type.
+func dnsTypeName(qtype uint16) string {
+	switch qtype {
+	case 1:
+		return "A"
+	case 2:
+		return "NS"
+	case 5:
+		return "CNAME"
+	case 6:
+		return "SOA"
+	case 12:
+		return "PTR"
+	case 15:
+		return "MX"
+	case 16:
+		return "TXT"
+	case 28:
+		return "AAAA"
+	case 33:
+		return "SRV"
+	case 64:
+		return "SVCB"
+	case 65:
+		return "HTTPS"
+	case 255:
+		return "ANY"
+	default:
+		return "TYPE" + strconv.FormatUint(uint64(qtype), 10)
+	}
+}
+
+// dnsResultName returns the label value for the outcome of a DNS lookup: the
+// response code, or "timeout" when no response was seen.
+func dnsResultName(event types.DNSEvent) string {
+	if event.TimedOut {
+		return "timeout"
+	}
+	switch event.RCode {
+	case 0:
+		return "noerror"
+	case 1:
+		return "formerr"
+	case 2:
+		return "servfail"
+	case 3:
+		return "nxdomain"
+	case 4:
+		return "notimp"
+	case 5:
+		return "refused"
+	default:
+		return "rcode" + strconv.FormatUint(uint64(event.RCode), 10)
+	}
+}
+
+// connDirection returns the label value for the side that opened a connection.
+func connDirection(d types.Direction) string {
+	switch d {
+	case types.DirectionInbound:
+		return "inbound"
+	case types.DirectionOutbound:
+		return "outbound"
+	default:
+		return "unknown"
+	}
+}
+
+// tcpStateName returns the label value for a TCP state.
+func tcpStateName(s types.TCPState) string {
+	switch s {
+	case types.TCPEstablished:
+		return "established"
+	case types.TCPSynSent:
+		return "syn_sent"
+	case types.TCPSynRecv:
+		return "syn_recv"
+	case types.TCPFinWait1:
+		return "fin_wait1"
+	case types.TCPFinWait2:
+		return "fin_wait2"
+	case types.TCPTimeWait:
+		return "time_wait"
+	case types.TCPClose:
+		return "close"
+	case types.TCPCloseWait:
+		return "close_wait"
+	case types.TCPLastAck:
+		return "last_ack"
+	case types.TCPListen:
+		return "listen"
+	case types.TCPClosing:
+		return "closing"
+	case types.TCPNewSynRecv:
+		return "new_syn_recv"
+	default:
+		return "unknown"
+	}
+}
@@ -10,7 +10,12 @@ import (
 )
 
 type DataDogAdapter struct {
-	client *statsd.Client
+	client        *statsd.Client
+	namespacedPID bool
+	// previous is the snapshot sent last. ConnMetrics holds running totals
+	// and statsd counts are summed, so only the growth since is sent.
+	// SendMetrics is called from the collector's reporting loop only.
+	previous types.ConnMetrics
 }
 
 func NewDataDogAdapter(settings map[string]string) (*DataDogAdapter, error) {
@@ -19,22 +24,31 @@ func NewDataDogAdapter(settings map[string]string) (*DataDogAdapter, error) {
 		host = "localhost:8125"
 	}
 
+	namespacedPID, err := parsePIDSetting(settings["pid"])
+	if err != nil {
+		return nil, err
+	}
+
 	client, err := statsd.New(host)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create DataDog client: %w", err)
 	}
 
 	return &DataDogAdapter{
-		client: client,
+		client:        client,
+		namespacedPID: namespacedPID,
 	}, nil
 }
 
 func (d *DataDogAdapter) SendMetrics(ctx context.Context, metrics types.ConnMetrics) error {
+	previous := d.previous
+	d.previous = metrics
+
 	if err := d.client.Gauge("gespann.open_connections", float64(metrics.OpenConnections), nil, 1); err != nil {
 		return err
 	}
 
-	if err := d.client.Count("gespann.closed_connections", metrics.ClosedConnections, nil, 1); err != nil {
+	if err := d.client.Count("gespann.closed_connections", metrics.ClosedConnections-previous.ClosedConnections, nil, 1); err != nil {
 		return err
 	}
 
@@ -42,7 +56,66 @@ func (d *DataDogAdapter) SendMetrics(ctx context.Context, metrics types.ConnMetr
 		return err
 	}
 
-	if err := d.client.Count("gespann.total_connections", metrics.TotalConnections, nil, 1); err != nil {
+	if err := d.client.Count("gespann.total_connections", metrics.TotalConnections-previous.TotalConnections, nil, 1); err != nil {
+		return err
+	}
+
+	directions := map[string][2]types.DirectionMetrics{
+		"inbound":  {metrics.Inbound, previous.Inbound},
+		"outbound": {metrics.Outbound, previous.Outbound},
+	}
+	for direction, dms := range directions {
+		dm, prev := dms[0], dms[1]
+		tags := []string{"direction:" + direction}
+		if err := d.client.Gauge("gespann.open_connections_by_direction", float64(dm.OpenConnections), tags, 1); err != nil {
+			return err
+		}
+		if err := d.client.Count("gespann.closed_connections_by_direction", dm.ClosedConnections-prev.ClosedConnections, tags, 1); err != nil {
+			return err
+		}
+		if err := d.client.Count("gespann.bytes_sent_by_direction", int64(dm.TotalBytesSent-prev.TotalBytesSent), tags, 1); err != nil {
+			return err
+		}
+		if err := d.client.Count("gespann.bytes_received_by_direction", int64(dm.TotalBytesReceived-prev.TotalBytesReceived), tags, 1); err != nil {
+			return err
+		}
+	}
+
+	for state, count := range metrics.TCPStates {
+		tags := []string{"state:" + tcpStateName(state)}
+		if err := d.client.Gauge("gespann.tcp_connections_by_state", float64(count), tags, 1); err != nil {
+			return err
+		}
+	}
+
+	if metrics.Program.Program != "" {
+		tags := []string{
+			"requested:" + metrics.Program.Requested,
+			"program:" + metrics.Program.Program,
+		}
+		if err := d.client.Gauge("gespann.tracker_program_info", 1, tags, 1); err != nil {
+			return err
+		}
+	}
+
+	for _, probe := range metrics.Probes {
+		attached := 0.0
+		if probe.State == types.ProbeAttached {
+			attached = 1
+		}
+		tags := []string{
+			"probe:" + probe.Name,
+			"required:" + strconv.FormatBool(probe.Required),
+		}
+		if err := d.client.Gauge("gespann.probe_attached", attached, tags, 1); err != nil {
+			return err
+		}
+	}
+
+	if err := d.client.Count("gespann.reconciled_connections", metrics.Corrections.Added, []string{"correction:added"}, 1); err != nil {
+		return err
+	}
+	if err := d.client.Count("gespann.reconciled_connections", metrics.Corrections.Removed, []string{"correction:removed"}, 1); err != nil {
 		return err
 	}
 
@@ -58,24 +131,168 @@ func (d *DataDogAdapter) SendEvent(ctx context.Context, event types.ConnEvent) e
 		eventType = "close"
 	case types.ConnIdle:
 		eventType = "idle"
+	case types.ConnReset:
+		eventType = "reset"
+	case types.ConnFailed:
+		eventType = "failed"
+	case types.ConnData:
+		eventType = "data"
+	case types.ConnStateChange:
+		eventType = "state_change"
+	case types.ConnActive:
+		eventType = "active"
+	case types.ConnExisting:
+		eventType = "existing"
 	}
 
 	tags := []string{
 		"event_type:" + eventType,
-		"pid:" + strconv.FormatUint(uint64(event.PID), 10),
-		fmt.Sprintf("src:%d.%d.%d.%d:%d",
-			event.SAddr&0xFF, (event.SAddr>>8)&0xFF,
-			(event.SAddr>>16)&0xFF, (event.SAddr>>24)&0xFF,
-			event.SPort),
-		fmt.Sprintf("dst:%d.%d.%d.%d:%d",
-			event.DAddr&0xFF, (event.DAddr>>8)&0xFF,
-			(event.DAddr>>16)&0xFF, (event.DAddr>>24)&0xFF,
-			event.DPort),
-	}
-
-	return d.client.Incr("gespann.connection_events", tags, 1)
+		"reset_reason:" + resetReasonName(event.ResetReason),
+		"pid:" + eventPID(event.PID, event.NamespacedPID, d.namespacedPID),
+		"process:" + processName(event.Process),
+		"direction:" + connDirection(event.Direction),
+		"family:" + addrFamily(event.DAddr),
+		"src:" + formatEndpoint(event.SAddr, event.SPort),
+		"dst:" + formatEndpoint(event.DAddr, event.DPort),
+	}
+	if event.Netns != 0 {
+		tags = append(tags, "netns:"+netnsName(event.Netns))
+	}
+	tags = append(tags, cgroupTags(event.Cgroup)...)
+	tags = append(tags, kubernetesTags(event)...)
+
+	if err := d.client.Incr("gespann.connection_events", tags, 1); err != nil {
+		return err
+	}
+
+	// Idle and state events carry running totals of open connections, only
+	// data deltas and teardown remainders may be added
+	if reportsTraffic(event) {
+		// Full slice expression, so each append copies the shared tags
+		base := tags[:len(tags):len(tags)]
+		if event.BytesSent > 0 {
+			if err := d.client.Count("gespann.bytes", int64(event.BytesSent), append(base, "traffic:sent"), 1); err != nil {
+				return err
+			}
+		}
+		if event.BytesReceived > 0 {
+			if err := d.client.Count("gespann.bytes", int64(event.BytesReceived), append(base, "traffic:received"), 1); err != nil {
+				return err
+			}
+		}
+	}
+
+	// RTT is sampled periodically and when the socket goes away
+	if event.RTTMicros > 0 && reportsTraffic(event) {
+		rttTags := []string{"destination:" + destination(event)}
+		if err := d.client.Distribution("gespann.rtt_microseconds", float64(event.RTTMicros), rttTags, 1); err != nil {
+			return err
+		}
+		if err := d.client.Distribution("gespann.rtt_variance_microseconds", float64(event.RTTVarMicros), rttTags, 1); err != nil {
+			return err
+		}
+	}
+
+	// Loss counters are reported as deltas, periodically and on teardown
+	if reportsTraffic(event) {
+		dstTags := []string{"destination:" + destination(event)}
+		if event.Retransmits > 0 {
+			if err := d.client.Count("gespann.retransmits", int64(event.Retransmits), dstTags, 1); err != nil {
+				return err
+			}
+		}
+		if event.RTOs > 0 {
+			if err := d.client.Count("gespann.retransmit_timeouts", int64(event.RTOs), dstTags, 1); err != nil {
+				return err
+			}
+		}
+		if event.LossProbes > 0 {
+			if err := d.client.Count("gespann.loss_probes", int64(event.LossProbes), dstTags, 1); err != nil {
+				return err
+			}
+		}
+	}
+
+	if event.ConnectMicros > 0 {
+		connectTags := []string{
+			"destination:" + destination(event),
+			"result:" + connectResult(event),
+		}
+		if err := d.client.Distribution("gespann.connect_latency_microseconds", float64(event.ConnectMicros), connectTags, 1); err != nil {
+			return err
+		}
+	}
+
+	if event.Type == types.ConnFailed {
+		failureTags := []string{
+			"failure_reason:" + failureReasonName(event.FailureReason),
+			"destination:" + destination(event),
+		}
+		if err := d.client.Incr("gespann.connect_failures", failureTags, 1); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (d *DataDogAdapter) SendDNSEvent(ctx context.Context, event types.DNSEvent) error {
+	tags := []string{
+		"qtype:" + dnsTypeName(event.QType),
+		"result:" + dnsResultName(event),
+		"name:" + event.Name,
+		"pid:" + eventPID(event.PID, event.NamespacedPID, d.namespacedPID),
+		"process:" + processName(event.Process),
+		"server:" + event.Server.String(),
+	}
+
+	if err := d.client.Incr("gespann.dns_queries", tags, 1); err != nil {
+		return err
+	}
+
+	if !event.TimedOut {
+		if err := d.client.Distribution("gespann.dns_latency_microseconds", float64(event.Latency.Microseconds()), tags, 1); err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
 func (d *DataDogAdapter) Close() error {
 	return d.client.Close()
 }
+
+// cgroupTags returns the container and systemd unit tags of a cgroup, only
+// those that are known.
+func cgroupTags(cgroup types.CgroupInfo) []string {
+	var tags []string
+	if cgroup.ContainerID != "" {
+		tags = append(tags, "container_id:"+cgroup.ContainerID, "container_runtime:"+cgroup.Runtime)
+	}
+	if cgroup.SystemdUnit != "" {
+		tags = append(tags, "systemd_unit:"+cgroup.SystemdUnit)
+	}
+	return tags
+}
+
+// kubernetesTags returns the pod and workload tags of both ends of a
+// connection, only those that are known.
+func kubernetesTags(event types.ConnEvent) []string {
+	var tags []string
+	if pod := event.Pod; pod != nil {
+		tags = append(tags,
+			"kube_namespace:"+pod.Namespace,
+			"pod_name:"+pod.Name,
+			"kube_workload_kind:"+pod.WorkloadKind,
+			"kube_workload:"+pod.Workload,
+		)
+	}
+	if namespace, workload := peerWorkload(event); workload != "" {
+		tags = append(tags, "peer_kube_namespace:"+namespace, "peer_kube_workload:"+workload)
+	}
+	if event.PeerService != nil {
+		tags = append(tags, "peer_kube_service:"+event.PeerService.Name)
+	}
+	return tags
+}
@@ -20,6 +20,10 @@ func (n *NoOpAdapter) SendEvent(ctx context.Context, event types.ConnEvent) erro
 	return nil
 }
 
+func (n *NoOpAdapter) SendDNSEvent(ctx context.Context, event types.DNSEvent) error {
+	return nil
+}
+
 func (n *NoOpAdapter) Close() error {
 	return nil
 }
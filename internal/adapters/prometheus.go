@@ -4,15 +4,29 @@ import (
 	"context"
 	"fmt"
 	"net/http"
+	"strconv"
 
 	"github.com/pedrospdc/gespann/pkg/types"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
+// ownerLabels identify where a connection lives and who owns it: the network
+// namespace, the process, its container or systemd unit, and in Kubernetes
+// the workloads on both ends.
+var ownerLabels = []string{
+	"netns", "process", "container_id", "container_runtime", "systemd_unit",
+	"namespace", "workload", "peer_namespace", "peer_workload",
+}
+
 type PrometheusAdapter struct {
-	registry *prometheus.Registry
-	server   *http.Server
+	registry      *prometheus.Registry
+	server        *http.Server
+	namespacedPID bool
+	// previous is the snapshot sent last. ConnMetrics holds running totals,
+	// counters are only added the growth since. SendMetrics is called from
+	// the collector's reporting loop only.
+	previous types.ConnMetrics
 
 	// Connection counts
 	openConnections   prometheus.Gauge
@@ -27,14 +41,37 @@ type PrometheusAdapter struct {
 	totalBytesReceived    prometheus.Counter
 	avgConnectionDuration prometheus.Gauge
 	avgRTT                prometheus.Gauge
+	avgConnectLatency     prometheus.Gauge
 
 	// Protocol distribution
 	tcpConnections prometheus.Counter
 	udpConnections prometheus.Counter
 
+	// Direction distribution
+	directionOpenConnections *prometheus.GaugeVec
+
+	// TCP state distribution
+	tcpStateConnections *prometheus.GaugeVec
+
 	// Event tracking
 	connectionEvents    *prometheus.CounterVec
 	connectionBandwidth *prometheus.CounterVec
+	rtt                 *prometheus.HistogramVec
+	rttVariance         *prometheus.HistogramVec
+	retransmits         *prometheus.CounterVec
+	retransmitTimeouts  *prometheus.CounterVec
+	lossProbes          *prometheus.CounterVec
+	connectLatency      *prometheus.HistogramVec
+	connectFailures     *prometheus.CounterVec
+
+	// DNS
+	dnsQueries *prometheus.CounterVec
+	dnsLatency *prometheus.HistogramVec
+
+	// Tracker self-metrics
+	programInfo           *prometheus.GaugeVec
+	probeAttached         *prometheus.GaugeVec
+	reconciledConnections *prometheus.CounterVec
 }
 
 func NewPrometheusAdapter(settings map[string]string) (*PrometheusAdapter, error) {
@@ -43,6 +80,11 @@ func NewPrometheusAdapter(settings map[string]string) (*PrometheusAdapter, error
 		port = "8080"
 	}
 
+	namespacedPID, err := parsePIDSetting(settings["pid"])
+	if err != nil {
+		return nil, err
+	}
+
 	registry := prometheus.NewRegistry()
 
 	// Connection count metrics
@@ -97,6 +139,11 @@ func NewPrometheusAdapter(settings map[string]string) (*PrometheusAdapter, error
 		Help: "Average round trip time in microseconds",
 	})
 
+	avgConnectLatency := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "gespann_avg_connect_latency_microseconds",
+		Help: "Average TCP handshake latency in microseconds",
+	})
+
 	// Protocol distribution
 	tcpConnections := prometheus.NewCounter(prometheus.CounterOpts{
 		Name: "gespann_tcp_connections_total",
@@ -108,13 +155,31 @@ func NewPrometheusAdapter(settings map[string]string) (*PrometheusAdapter, error
 		Help: "Total number of UDP connections",
 	})
 
+	// Direction distribution
+	directionOpenConnections := prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "gespann_open_connections_by_direction",
+			Help: "Number of currently open connections by direction",
+		},
+		[]string{"conn_direction"},
+	)
+
+	// TCP state distribution
+	tcpStateConnections := prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "gespann_tcp_connections_by_state",
+			Help: "Number of TCP sockets in each TCP state",
+		},
+		[]string{"state"},
+	)
+
 	// Event tracking
 	connectionEvents := prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "gespann_connection_events_total",
 			Help: "Total number of connection events by type",
 		},
-		[]string{"event_type", "protocol", "reset_reason"},
+		append([]string{"event_type", "protocol", "reset_reason", "family", "conn_direction", "pid"}, ownerLabels...),
 	)
 
 	connectionBandwidth := prometheus.NewCounterVec(
@@ -122,14 +187,119 @@ func NewPrometheusAdapter(settings map[string]string) (*PrometheusAdapter, error
 			Name: "gespann_connection_bandwidth_bytes_total",
 			Help: "Total bandwidth usage by connection",
 		},
-		[]string{"direction", "protocol"},
+		append([]string{"direction", "protocol", "conn_direction"}, ownerLabels...),
+	)
+
+	rtt := prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "gespann_rtt_microseconds",
+			Help:    "Smoothed TCP round trip time by destination",
+			Buckets: prometheus.ExponentialBuckets(50, 2, 16),
+		},
+		[]string{"destination"},
+	)
+
+	rttVariance := prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "gespann_rtt_variance_microseconds",
+			Help:    "TCP round trip time variance by destination",
+			Buckets: prometheus.ExponentialBuckets(50, 2, 16),
+		},
+		[]string{"destination"},
+	)
+
+	retransmits := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gespann_retransmits_total",
+			Help: "Total TCP segment retransmissions by destination",
+		},
+		[]string{"destination"},
+	)
+
+	retransmitTimeouts := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gespann_retransmit_timeouts_total",
+			Help: "Total TCP retransmission timeouts (RTO) by destination",
+		},
+		[]string{"destination"},
+	)
+
+	lossProbes := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gespann_loss_probes_total",
+			Help: "Total TCP tail loss probes (TLP) by destination",
+		},
+		[]string{"destination"},
+	)
+
+	connectLatency := prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "gespann_connect_latency_microseconds",
+			Help:    "Time from tcp_connect to ESTABLISHED or failure by destination",
+			Buckets: prometheus.ExponentialBuckets(100, 2, 21),
+		},
+		[]string{"destination", "result"},
+	)
+
+	connectFailures := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gespann_connect_failures_total",
+			Help: "Total failed connect attempts by failure reason and destination",
+		},
+		[]string{"failure_reason", "destination"},
+	)
+
+	// DNS
+	dnsQueries := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gespann_dns_queries_total",
+			Help: "Total DNS lookups by query type and result",
+		},
+		[]string{"qtype", "result", "pid", "process"},
+	)
+
+	dnsLatency := prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "gespann_dns_latency_microseconds",
+			Help:    "DNS lookup latency by server",
+			Buckets: prometheus.ExponentialBuckets(100, 2, 16),
+		},
+		[]string{"server", "process"},
+	)
+
+	// Tracker self-metrics
+	programInfo := prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "gespann_tracker_program_info",
+			Help: "The eBPF program set requested in the configuration and the one loaded, always 1",
+		},
+		[]string{"requested", "program"},
+	)
+	probeAttached := prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "gespann_probe_attached",
+			Help: "Whether an eBPF probe is attached (1) or detached (0)",
+		},
+		[]string{"probe", "required"},
+	)
+	reconciledConnections := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "gespann_reconciled_connections_total",
+			Help: "Open connections corrected from kernel state after their open or teardown event was lost",
+		},
+		[]string{"correction"},
 	)
 
 	registry.MustRegister(
 		openConnections, closedConnections, idleConnections,
 		resetConnections, failedConnections, totalConnections,
 		totalBytesSent, totalBytesReceived, avgConnectionDuration, avgRTT,
-		tcpConnections, udpConnections, connectionEvents, connectionBandwidth,
+		avgConnectLatency,
+		tcpConnections, udpConnections, directionOpenConnections,
+		tcpStateConnections, connectionEvents, connectionBandwidth,
+		rtt, rttVariance, retransmits, retransmitTimeouts, lossProbes,
+		connectLatency, connectFailures, dnsQueries, dnsLatency, programInfo,
+		probeAttached, reconciledConnections,
 	)
 
 	mux := http.NewServeMux()
@@ -141,22 +311,38 @@ func NewPrometheusAdapter(settings map[string]string) (*PrometheusAdapter, error
 	}
 
 	adapter := &PrometheusAdapter{
-		registry:              registry,
-		server:                server,
-		openConnections:       openConnections,
-		closedConnections:     closedConnections,
-		idleConnections:       idleConnections,
-		resetConnections:      resetConnections,
-		failedConnections:     failedConnections,
-		totalConnections:      totalConnections,
-		totalBytesSent:        totalBytesSent,
-		totalBytesReceived:    totalBytesReceived,
-		avgConnectionDuration: avgConnectionDuration,
-		avgRTT:                avgRTT,
-		tcpConnections:        tcpConnections,
-		udpConnections:        udpConnections,
-		connectionEvents:      connectionEvents,
-		connectionBandwidth:   connectionBandwidth,
+		registry:                 registry,
+		server:                   server,
+		namespacedPID:            namespacedPID,
+		openConnections:          openConnections,
+		closedConnections:        closedConnections,
+		idleConnections:          idleConnections,
+		resetConnections:         resetConnections,
+		failedConnections:        failedConnections,
+		totalConnections:         totalConnections,
+		totalBytesSent:           totalBytesSent,
+		totalBytesReceived:       totalBytesReceived,
+		avgConnectionDuration:    avgConnectionDuration,
+		avgRTT:                   avgRTT,
+		avgConnectLatency:        avgConnectLatency,
+		tcpConnections:           tcpConnections,
+		udpConnections:           udpConnections,
+		directionOpenConnections: directionOpenConnections,
+		tcpStateConnections:      tcpStateConnections,
+		connectionEvents:         connectionEvents,
+		connectionBandwidth:      connectionBandwidth,
+		rtt:                      rtt,
+		rttVariance:              rttVariance,
+		retransmits:              retransmits,
+		retransmitTimeouts:       retransmitTimeouts,
+		lossProbes:               lossProbes,
+		connectLatency:           connectLatency,
+		connectFailures:          connectFailures,
+		dnsQueries:               dnsQueries,
+		dnsLatency:               dnsLatency,
+		programInfo:              programInfo,
+		probeAttached:            probeAttached,
+		reconciledConnections:    reconciledConnections,
 	}
 
 	go func() {
@@ -169,23 +355,50 @@ func NewPrometheusAdapter(settings map[string]string) (*PrometheusAdapter, error
 }
 
 func (p *PrometheusAdapter) SendMetrics(ctx context.Context, metrics types.ConnMetrics) error {
+	previous := p.previous
+	p.previous = metrics
+
 	// Connection counts
 	p.openConnections.Set(float64(metrics.OpenConnections))
 	p.idleConnections.Set(float64(metrics.IdleConnections))
-	p.closedConnections.Add(float64(metrics.ClosedConnections))
-	p.resetConnections.Add(float64(metrics.ResetConnections))
-	p.failedConnections.Add(float64(metrics.FailedConnections))
-	p.totalConnections.Add(float64(metrics.TotalConnections))
+	p.closedConnections.Add(float64(metrics.ClosedConnections - previous.ClosedConnections))
+	p.resetConnections.Add(float64(metrics.ResetConnections - previous.ResetConnections))
+	p.failedConnections.Add(float64(metrics.FailedConnections - previous.FailedConnections))
+	p.totalConnections.Add(float64(metrics.TotalConnections - previous.TotalConnections))
 
 	// Performance metrics
-	p.totalBytesSent.Add(float64(metrics.TotalBytesSent))
-	p.totalBytesReceived.Add(float64(metrics.TotalBytesReceived))
+	p.totalBytesSent.Add(float64(metrics.TotalBytesSent - previous.TotalBytesSent))
+	p.totalBytesReceived.Add(float64(metrics.TotalBytesReceived - previous.TotalBytesReceived))
 	p.avgConnectionDuration.Set(metrics.AvgConnectionDuration)
 	p.avgRTT.Set(metrics.AvgRTT)
+	p.avgConnectLatency.Set(metrics.AvgConnectLatency)
 
 	// Protocol distribution
-	p.tcpConnections.Add(float64(metrics.TCPConnections))
-	p.udpConnections.Add(float64(metrics.UDPConnections))
+	p.tcpConnections.Add(float64(metrics.TCPConnections - previous.TCPConnections))
+	p.udpConnections.Add(float64(metrics.UDPConnections - previous.UDPConnections))
+
+	// Direction distribution
+	p.directionOpenConnections.WithLabelValues("inbound").Set(float64(metrics.Inbound.OpenConnections))
+	p.directionOpenConnections.WithLabelValues("outbound").Set(float64(metrics.Outbound.OpenConnections))
+
+	// TCP state distribution
+	for state, count := range metrics.TCPStates {
+		p.tcpStateConnections.WithLabelValues(tcpStateName(state)).Set(float64(count))
+	}
+
+	// Tracker self-metrics
+	if metrics.Program.Program != "" {
+		p.programInfo.WithLabelValues(metrics.Program.Requested, metrics.Program.Program).Set(1)
+	}
+	for _, probe := range metrics.Probes {
+		attached := 0.0
+		if probe.State == types.ProbeAttached {
+			attached = 1
+		}
+		p.probeAttached.WithLabelValues(probe.Name, strconv.FormatBool(probe.Required)).Set(attached)
+	}
+	p.reconciledConnections.WithLabelValues("added").Add(float64(metrics.Corrections.Added))
+	p.reconciledConnections.WithLabelValues("removed").Add(float64(metrics.Corrections.Removed))
 
 	return nil
 }
@@ -205,6 +418,12 @@ func (p *PrometheusAdapter) SendEvent(ctx context.Context, event types.ConnEvent
 		eventType = "failed"
 	case types.ConnData:
 		eventType = "data"
+	case types.ConnStateChange:
+		eventType = "state_change"
+	case types.ConnActive:
+		eventType = "active"
+	case types.ConnExisting:
+		eventType = "existing"
 	}
 
 	protocol := ""
@@ -217,26 +436,61 @@ func (p *PrometheusAdapter) SendEvent(ctx context.Context, event types.ConnEvent
 		protocol = "unknown"
 	}
 
-	resetReason := ""
-	switch event.ResetReason {
-	case types.ResetNormal:
-		resetReason = "normal"
-	case types.ResetTimeout:
-		resetReason = "timeout"
-	case types.ResetRefused:
-		resetReason = "refused"
-	case types.ResetAbort:
-		resetReason = "abort"
+	direction := connDirection(event.Direction)
+	owner := ownerLabelValues(event)
+
+	pid := eventPID(event.PID, event.NamespacedPID, p.namespacedPID)
+	p.connectionEvents.WithLabelValues(append([]string{eventType, protocol, resetReasonName(event.ResetReason), addrFamily(event.DAddr), direction, pid}, owner...)...).Inc()
+
+	// Track bandwidth. Idle and state events carry running totals of open
+	// connections, only data deltas and teardown remainders may be added.
+	if reportsTraffic(event) {
+		if event.BytesSent > 0 {
+			p.connectionBandwidth.WithLabelValues(append([]string{"sent", protocol, direction}, owner...)...).Add(float64(event.BytesSent))
+		}
+		if event.BytesReceived > 0 {
+			p.connectionBandwidth.WithLabelValues(append([]string{"received", protocol, direction}, owner...)...).Add(float64(event.BytesReceived))
+		}
+	}
+
+	// RTT is sampled periodically and when the socket goes away
+	if event.RTTMicros > 0 && reportsTraffic(event) {
+		dst := destination(event)
+		p.rtt.WithLabelValues(dst).Observe(float64(event.RTTMicros))
+		p.rttVariance.WithLabelValues(dst).Observe(float64(event.RTTVarMicros))
+	}
+
+	// Loss counters are reported as deltas like bandwidth
+	if reportsTraffic(event) {
+		dst := destination(event)
+		if event.Retransmits > 0 {
+			p.retransmits.WithLabelValues(dst).Add(float64(event.Retransmits))
+		}
+		if event.RTOs > 0 {
+			p.retransmitTimeouts.WithLabelValues(dst).Add(float64(event.RTOs))
+		}
+		if event.LossProbes > 0 {
+			p.lossProbes.WithLabelValues(dst).Add(float64(event.LossProbes))
+		}
 	}
 
-	p.connectionEvents.WithLabelValues(eventType, protocol, resetReason).Inc()
+	if event.ConnectMicros > 0 {
+		p.connectLatency.WithLabelValues(destination(event), connectResult(event)).Observe(float64(event.ConnectMicros))
+	}
 
-	// Track bandwidth
-	if event.BytesSent > 0 {
-		p.connectionBandwidth.WithLabelValues("sent", protocol).Add(float64(event.BytesSent))
+	if event.Type == types.ConnFailed {
+		p.connectFailures.WithLabelValues(failureReasonName(event.FailureReason), destination(event)).Inc()
 	}
-	if event.BytesReceived > 0 {
-		p.connectionBandwidth.WithLabelValues("received", protocol).Add(float64(event.BytesReceived))
+
+	return nil
+}
+
+func (p *PrometheusAdapter) SendDNSEvent(ctx context.Context, event types.DNSEvent) error {
+	process := processName(event.Process)
+	p.dnsQueries.WithLabelValues(dnsTypeName(event.QType), dnsResultName(event), eventPID(event.PID, event.NamespacedPID, p.namespacedPID), process).Inc()
+
+	if !event.TimedOut {
+		p.dnsLatency.WithLabelValues(event.Server.String(), process).Observe(float64(event.Latency.Microseconds()))
 	}
 
 	return nil
@@ -245,3 +499,13 @@ func (p *PrometheusAdapter) SendEvent(ctx context.Context, event types.ConnEvent
 func (p *PrometheusAdapter) Close() error {
 	return p.server.Shutdown(context.Background())
 }
+
+// ownerLabelValues returns the values of ownerLabels for an event.
+func ownerLabelValues(event types.ConnEvent) []string {
+	namespace, workload := podWorkload(event.Pod)
+	peerNamespace, peer := peerWorkload(event)
+	return []string{
+		netnsName(event.Netns), processName(event.Process), event.Cgroup.ContainerID, event.Cgroup.Runtime, event.Cgroup.SystemdUnit,
+		namespace, workload, peerNamespace, peer,
+	}
+}
@@ -3,14 +3,26 @@ package config
 import (
 	"fmt"
 	"os"
+	"time"
 
 	"github.com/pedrospdc/gespann/internal/adapters"
+	"github.com/pedrospdc/gespann/internal/ebpf"
+	"github.com/pedrospdc/gespann/internal/kubernetes"
 	"gopkg.in/yaml.v3"
 )
 
+const (
+	defaultIdleThreshold     = 30 * time.Second
+	defaultDataInterval      = 15 * time.Second
+	defaultUDPTimeout        = 60 * time.Second
+	defaultReconcileInterval = 60 * time.Second
+)
+
 type Config struct {
-	LogLevel string            `yaml:"log_level"`
-	Adapters []adapters.Config `yaml:"adapters"`
+	LogLevel   string            `yaml:"log_level"`
+	Adapters   []adapters.Config `yaml:"adapters"`
+	Tracker    ebpf.Config       `yaml:"tracker"`
+	Kubernetes kubernetes.Config `yaml:"kubernetes"`
 }
 
 func Load(path string) (*Config, error) {
@@ -28,12 +40,39 @@ func Load(path string) (*Config, error) {
 		config.LogLevel = "info"
 	}
 
+	if config.Tracker.Program == "" {
+		config.Tracker.Program = ebpf.ProgramAuto
+	}
+
+	if config.Tracker.IdleThreshold == 0 {
+		config.Tracker.IdleThreshold = defaultIdleThreshold
+	}
+
+	if config.Tracker.DataInterval == 0 {
+		config.Tracker.DataInterval = defaultDataInterval
+	}
+
+	if config.Tracker.UDPFlowTimeout == 0 {
+		config.Tracker.UDPFlowTimeout = defaultUDPTimeout
+	}
+
+	if config.Tracker.ReconcileInterval == 0 {
+		config.Tracker.ReconcileInterval = defaultReconcileInterval
+	}
+
 	return &config, nil
 }
 
 func Default() *Config {
 	return &Config{
 		LogLevel: "info",
+		Tracker: ebpf.Config{
+			Program:           ebpf.ProgramAuto,
+			IdleThreshold:     defaultIdleThreshold,
+			DataInterval:      defaultDataInterval,
+			UDPFlowTimeout:    defaultUDPTimeout,
+			ReconcileInterval: defaultReconcileInterval,
+		},
 		Adapters: []adapters.Config{
 			{
 				Type: "prometheus",
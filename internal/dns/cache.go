@@ -0,0 +1,131 @@
+package dns
+
+import (
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/pedrospdc/gespann/pkg/types"
+)
+
+const (
+	// Applications keep using resolved addresses well past the record TTL,
+	// names are kept at least this long.
+	minCacheTTL     = 5 * time.Minute
+	maxCacheEntries = 65536
+)
+
+type cacheEntry struct {
+	name    string
+	expires time.Time
+}
+
+// addrKey scopes an address to the network namespace it was resolved in,
+// containers reuse addresses.
+type addrKey struct {
+	netns uint32
+	addr  netip.Addr
+}
+
+// processKey scopes a resolved address to the process that resolved it.
+type processKey struct {
+	pid  uint32
+	addr netip.Addr
+}
+
+// Cache maps addresses to the name they were resolved from. Names a process
+// resolved itself through getaddrinfo take precedence over those seen in
+// DNS traffic, which may come from any process on the host.
+type Cache struct {
+	mu        sync.RWMutex
+	entries   map[addrKey]cacheEntry
+	processes map[processKey]cacheEntry
+}
+
+func NewCache() *Cache {
+	return &Cache{
+		entries:   make(map[addrKey]cacheEntry),
+		processes: make(map[processKey]cacheEntry),
+	}
+}
+
+// Add records that name resolved to addr in network namespace netns.
+func (c *Cache) Add(netns uint32, name string, addr netip.Addr, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := addrKey{netns, addr.Unmap()}
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= maxCacheEntries {
+		return
+	}
+	c.entries[key] = cacheEntry{name: name, expires: time.Now().Add(max(ttl, minCacheTTL))}
+}
+
+// AddResolution records the addresses a process resolved a hostname to.
+func (c *Cache) AddResolution(resolution types.Resolution) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	expires := time.Now().Add(minCacheTTL)
+	for _, addr := range resolution.Addrs {
+		key := processKey{resolution.PID, addr.Unmap()}
+		if _, ok := c.processes[key]; !ok && len(c.processes) >= maxCacheEntries {
+			return
+		}
+		c.processes[key] = cacheEntry{name: resolution.Hostname, expires: expires}
+	}
+}
+
+// Lookup returns the name addr was last resolved from in network namespace netns.
+func (c *Cache) Lookup(netns uint32, addr netip.Addr) (string, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	entry, ok := c.entries[addrKey{netns, addr.Unmap()}]
+	if !ok || time.Now().After(entry.expires) {
+		return "", false
+	}
+	return entry.name, true
+}
+
+// lookupProcess returns the name pid resolved addr from.
+func (c *Cache) lookupProcess(pid uint32, addr netip.Addr) (string, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	entry, ok := c.processes[processKey{pid, addr.Unmap()}]
+	if !ok || time.Now().After(entry.expires) {
+		return "", false
+	}
+	return entry.name, true
+}
+
+// Annotate sets the destination name of an outbound connection.
+func (c *Cache) Annotate(event *types.ConnEvent) {
+	if event.Direction == types.DirectionInbound {
+		return
+	}
+	if name, ok := c.lookupProcess(event.PID, event.DAddr); ok {
+		event.DestinationName = name
+		return
+	}
+	if name, ok := c.Lookup(event.Netns, event.DAddr); ok {
+		event.DestinationName = name
+	}
+}
+
+func (c *Cache) prune(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key, entry := range c.entries {
+		if now.After(entry.expires) {
+			delete(c.entries, key)
+		}
+	}
+	for key, entry := range c.processes {
+		if now.After(entry.expires) {
+			delete(c.processes, key)
+		}
+	}
+}
@@ -0,0 +1,224 @@
+package dns
+
+import (
+	"encoding/binary"
+	"errors"
+	"net/netip"
+	"strings"
+)
+
+const (
+	headerLen    = 12
+	flagResponse = 1 << 15
+	rcodeMask    = 0xf
+
+	typeA     = 1
+	typeCNAME = 5
+	typeAAAA  = 28
+
+	// Compression pointers allowed in a single name, guards against loops.
+	maxPointers = 16
+
+	// Over TCP every message is preceded by its length (RFC 1035 4.2.2).
+	tcpPrefixLen = 2
+)
+
+var errTruncated = errors.New("truncated DNS message")
+
+// message is the part of a DNS message gespann cares about.
+type message struct {
+	id       uint16
+	response bool
+	rcode    uint8
+	name     string
+	qtype    uint16
+	answers  []answer
+	// truncated is set when the message ended, or turned malformed, before
+	// all records were read. What came before is still returned.
+	truncated bool
+}
+
+type answer struct {
+	rtype uint16
+	ttl   uint32
+	addr  netip.Addr
+}
+
+// parseMessage decodes the header, the first question and the address
+// records of the answer section. The kernel captures at most DNS_MAX_LEN
+// bytes, so large responses are cut short. Only a message without a full
+// header is an error, otherwise the records before the cut are returned.
+func parseMessage(b []byte) (message, error) {
+	if len(b) < headerLen {
+		return message{}, errTruncated
+	}
+
+	flags := binary.BigEndian.Uint16(b[2:])
+	msg := message{
+		id:       binary.BigEndian.Uint16(b),
+		response: flags&flagResponse != 0,
+		rcode:    uint8(flags & rcodeMask),
+	}
+	if err := msg.parseRecords(b); err != nil {
+		msg.truncated = true
+	}
+	return msg, nil
+}
+
+// parseRecords decodes the question and answer sections following the header.
+func (msg *message) parseRecords(b []byte) error {
+	qdcount := binary.BigEndian.Uint16(b[4:])
+	ancount := binary.BigEndian.Uint16(b[6:])
+
+	off := headerLen
+	for i := 0; i < int(qdcount); i++ {
+		name, next, err := readName(b, off)
+		if err != nil {
+			return err
+		}
+		if next+4 > len(b) {
+			return errTruncated
+		}
+		if i == 0 {
+			msg.name = name
+			msg.qtype = binary.BigEndian.Uint16(b[next:])
+		}
+		off = next + 4
+	}
+
+	for i := 0; i < int(ancount); i++ {
+		_, next, err := readName(b, off)
+		if err != nil {
+			return err
+		}
+		if next+10 > len(b) {
+			return errTruncated
+		}
+		rtype := binary.BigEndian.Uint16(b[next:])
+		ttl := binary.BigEndian.Uint32(b[next+4:])
+		rdlen := int(binary.BigEndian.Uint16(b[next+8:]))
+		rdata := next + 10
+		if rdata+rdlen > len(b) {
+			return errTruncated
+		}
+
+		switch {
+		case rtype == typeA && rdlen == 4:
+			msg.answers = append(msg.answers, answer{rtype, ttl, netip.AddrFrom4([4]byte(b[rdata:]))})
+		case rtype == typeAAAA && rdlen == 16:
+			msg.answers = append(msg.answers, answer{rtype, ttl, netip.AddrFrom16([16]byte(b[rdata:]))})
+		}
+		off = rdata + rdlen
+	}
+
+	return nil
+}
+
+// readName decodes a possibly compressed name at off and returns it with the
+// offset following it.
+func readName(b []byte, off int) (string, int, error) {
+	var labels []string
+	next := -1
+	pointers := 0
+
+	for {
+		if off >= len(b) {
+			return "", 0, errTruncated
+		}
+		length := int(b[off])
+		switch {
+		case length == 0:
+			if next < 0 {
+				next = off + 1
+			}
+			return strings.Join(labels, "."), next, nil
+		case length&0xc0 == 0xc0:
+			if off+1 >= len(b) {
+				return "", 0, errTruncated
+			}
+			pointers++
+			if pointers > maxPointers {
+				return "", 0, errors.New("too many compression pointers in DNS name")
+			}
+			if next < 0 {
+				next = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(b[off:]) & 0x3fff)
+		default:
+			if off+1+length > len(b) {
+				return "", 0, errTruncated
+			}
+			labels = append(labels, string(b[off+1:off+1+length]))
+			off += 1 + length
+		}
+	}
+}
+
+// tcpStream splits one direction of a TCP DNS connection into messages,
+// dropping the length prefix of each. The kernel copies at most DNS_MAX_LEN
+// bytes of every read or write, the bytes past that are missing.
+type tcpStream struct {
+	prefix []byte
+	msg    []byte
+	// remaining counts the message bytes still to come, zero while the
+	// length prefix is read
+	remaining int
+	// cut is set when bytes of the current message are missing, what
+	// follows the gap is not kept
+	cut bool
+	// lost is set once missing bytes covered a length prefix, the message
+	// boundaries are unknown from then on
+	lost bool
+}
+
+// feed adds a piece of the stream, data followed by missing bytes that
+// were not captured, and returns the messages it completed. Messages with
+// missing bytes are returned cut short.
+func (s *tcpStream) feed(data []byte, missing int) [][]byte {
+	if s.lost {
+		return nil
+	}
+
+	var msgs [][]byte
+	for len(data) > 0 {
+		if s.remaining == 0 {
+			n := min(tcpPrefixLen-len(s.prefix), len(data))
+			s.prefix = append(s.prefix, data[:n]...)
+			data = data[n:]
+			if len(s.prefix) == tcpPrefixLen {
+				s.remaining = int(binary.BigEndian.Uint16(s.prefix))
+				s.prefix = s.prefix[:0]
+			}
+			continue
+		}
+
+		n := min(s.remaining, len(data))
+		if !s.cut {
+			s.msg = append(s.msg, data[:n]...)
+		}
+		data = data[n:]
+		s.remaining -= n
+		if s.remaining == 0 {
+			msgs = append(msgs, s.msg)
+			s.msg, s.cut = nil, false
+		}
+	}
+
+	if missing == 0 {
+		return msgs
+	}
+	if s.remaining == 0 {
+		s.lost = true
+		return msgs
+	}
+	if missing < s.remaining {
+		s.remaining -= missing
+		s.cut = true
+		return msgs
+	}
+	// The gap ends the message, and covers the next prefix if it goes on
+	msgs = append(msgs, s.msg)
+	s.lost = missing > s.remaining
+	s.msg, s.cut, s.remaining = nil, false, 0
+	return msgs
+}
@@ -0,0 +1,300 @@
+package dns
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net/netip"
+	"testing"
+)
+
+// builder assembles DNS messages for the parser tests.
+type builder struct {
+	b []byte
+}
+
+func newBuilder(id, flags, qdcount, ancount uint16) *builder {
+	b := make([]byte, headerLen)
+	binary.BigEndian.PutUint16(b, id)
+	binary.BigEndian.PutUint16(b[2:], flags)
+	binary.BigEndian.PutUint16(b[4:], qdcount)
+	binary.BigEndian.PutUint16(b[6:], ancount)
+	return &builder{b: b}
+}
+
+// name appends an uncompressed name and returns its offset.
+func (m *builder) name(labels ...string) int {
+	off := len(m.b)
+	for _, l := range labels {
+		m.b = append(m.b, byte(len(l)))
+		m.b = append(m.b, l...)
+	}
+	m.b = append(m.b, 0)
+	return off
+}
+
+func (m *builder) pointer(off int) {
+	m.b = binary.BigEndian.AppendUint16(m.b, 0xc000|uint16(off))
+}
+
+func (m *builder) question(qtype uint16) {
+	m.b = binary.BigEndian.AppendUint16(m.b, qtype)
+	m.b = binary.BigEndian.AppendUint16(m.b, 1)
+}
+
+// record appends the fixed part of a resource record and its data, the owner
+// name must already be written.
+func (m *builder) record(rtype uint16, ttl uint32, rdata []byte) {
+	m.b = binary.BigEndian.AppendUint16(m.b, rtype)
+	m.b = binary.BigEndian.AppendUint16(m.b, 1)
+	m.b = binary.BigEndian.AppendUint32(m.b, ttl)
+	m.b = binary.BigEndian.AppendUint16(m.b, uint16(len(rdata)))
+	m.b = append(m.b, rdata...)
+}
+
+// cnameResponse answers www.example.com with a CNAME to cdn.example.net,
+// which in turn resolves to an A and an AAAA record.
+func cnameResponse() []byte {
+	m := newBuilder(0x1234, flagResponse|0x0100|0x0080, 1, 3)
+	qname := m.name("www", "example", "com")
+	m.question(typeA)
+
+	m.pointer(qname)
+	cname := []byte{3, 'c', 'd', 'n', 7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 3, 'n', 'e', 't', 0}
+	m.record(typeCNAME, 300, cname)
+	cdn := len(m.b) - len(cname)
+
+	m.pointer(cdn)
+	m.record(typeA, 60, []byte{192, 0, 2, 1})
+	m.pointer(cdn)
+	m.record(typeAAAA, 60, netip.MustParseAddr("2001:db8::1").AsSlice())
+	return m.b
+}
+
+func TestParseMessage(t *testing.T) {
+	msg, err := parseMessage(cnameResponse())
+	if err != nil {
+		t.Fatalf("parseMessage: %v", err)
+	}
+	if msg.id != 0x1234 || !msg.response || msg.rcode != 0 {
+		t.Errorf("header = id %#x response %t rcode %d", msg.id, msg.response, msg.rcode)
+	}
+	if msg.name != "www.example.com" || msg.qtype != typeA {
+		t.Errorf("question = %q type %d", msg.name, msg.qtype)
+	}
+	if msg.truncated {
+		t.Error("complete message reported as truncated")
+	}
+
+	want := []answer{
+		{typeA, 60, netip.MustParseAddr("192.0.2.1")},
+		{typeAAAA, 60, netip.MustParseAddr("2001:db8::1")},
+	}
+	if len(msg.answers) != len(want) {
+		t.Fatalf("answers = %v, want %v", msg.answers, want)
+	}
+	for i := range want {
+		if msg.answers[i] != want[i] {
+			t.Errorf("answers[%d] = %v, want %v", i, msg.answers[i], want[i])
+		}
+	}
+}
+
+func TestParseMessageQuery(t *testing.T) {
+	m := newBuilder(7, 0x0100, 1, 0)
+	m.name("example", "org")
+	m.question(typeAAAA)
+
+	msg, err := parseMessage(m.b)
+	if err != nil {
+		t.Fatalf("parseMessage: %v", err)
+	}
+	if msg.response || msg.name != "example.org" || msg.qtype != typeAAAA || len(msg.answers) != 0 {
+		t.Errorf("query parsed as %+v", msg)
+	}
+}
+
+func TestParseMessageTruncated(t *testing.T) {
+	full := cnameResponse()
+	complete, err := parseMessage(full)
+	if err != nil {
+		t.Fatalf("parseMessage: %v", err)
+	}
+
+	// Cutting anywhere after the header keeps the header and every answer
+	// that ended before the cut.
+	for n := headerLen; n < len(full); n++ {
+		msg, err := parseMessage(full[:n])
+		if err != nil {
+			t.Fatalf("cut at %d: %v", n, err)
+		}
+		if !msg.truncated {
+			t.Errorf("cut at %d: not reported as truncated", n)
+		}
+		if msg.id != complete.id || msg.rcode != complete.rcode || !msg.response {
+			t.Errorf("cut at %d: header = %+v", n, msg)
+		}
+		if len(msg.answers) > len(complete.answers) {
+			t.Fatalf("cut at %d: %d answers, message has %d", n, len(msg.answers), len(complete.answers))
+		}
+		for i, a := range msg.answers {
+			if a != complete.answers[i] {
+				t.Errorf("cut at %d: answers[%d] = %v, want %v", n, i, a, complete.answers[i])
+			}
+		}
+	}
+
+	// The AAAA record is the last one, cutting its data keeps the A record.
+	msg, _ := parseMessage(full[:len(full)-1])
+	if len(msg.answers) != 1 || msg.answers[0].rtype != typeA {
+		t.Errorf("answers before the cut = %v", msg.answers)
+	}
+}
+
+func TestParseMessageRcode(t *testing.T) {
+	m := newBuilder(9, flagResponse|3, 1, 0)
+	m.name("missing", "example")
+	// The question is cut, NXDOMAIN must still come through.
+	msg, err := parseMessage(m.b)
+	if err != nil {
+		t.Fatalf("parseMessage: %v", err)
+	}
+	if msg.rcode != 3 || !msg.truncated {
+		t.Errorf("rcode %d truncated %t, want 3 and true", msg.rcode, msg.truncated)
+	}
+}
+
+func TestParseMessageShortHeader(t *testing.T) {
+	if _, err := parseMessage(make([]byte, headerLen-1)); !errors.Is(err, errTruncated) {
+		t.Errorf("err = %v, want %v", err, errTruncated)
+	}
+}
+
+func TestParseMessageCompressionLoop(t *testing.T) {
+	m := newBuilder(1, flagResponse, 1, 1)
+	m.name("loop", "example")
+	m.question(typeA)
+	// The answer's owner name points at itself.
+	m.pointer(len(m.b))
+	m.record(typeA, 60, []byte{192, 0, 2, 1})
+
+	msg, err := parseMessage(m.b)
+	if err != nil {
+		t.Fatalf("parseMessage: %v", err)
+	}
+	if !msg.truncated || len(msg.answers) != 0 || msg.name != "loop.example" {
+		t.Errorf("loop parsed as %+v", msg)
+	}
+}
+
+func TestReadName(t *testing.T) {
+	m := &builder{b: make([]byte, headerLen)}
+	base := m.name("example", "com")
+	www := len(m.b)
+	m.b = append(m.b, 3, 'w', 'w', 'w')
+	m.pointer(base)
+	// A pointer to a pointer.
+	alias := len(m.b)
+	m.pointer(www)
+	// Two pointers referencing each other.
+	a := len(m.b)
+	m.pointer(a + 2)
+	m.pointer(a)
+
+	tests := []struct {
+		off     int
+		name    string
+		next    int
+		wantErr bool
+	}{
+		{off: base, name: "example.com", next: www},
+		{off: www, name: "www.example.com", next: alias},
+		{off: alias, name: "www.example.com", next: alias + 2},
+		{off: a, wantErr: true},
+		{off: len(m.b), wantErr: true},
+	}
+	for _, tt := range tests {
+		name, next, err := readName(m.b, tt.off)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("readName(%d) = %q, want error", tt.off, name)
+			}
+			continue
+		}
+		if err != nil || name != tt.name || next != tt.next {
+			t.Errorf("readName(%d) = %q, %d, %v, want %q, %d", tt.off, name, next, err, tt.name, tt.next)
+		}
+	}
+}
+
+// prefixed frames messages as they are sent over TCP.
+func prefixed(msgs ...[]byte) []byte {
+	var b []byte
+	for _, m := range msgs {
+		b = binary.BigEndian.AppendUint16(b, uint16(len(m)))
+		b = append(b, m...)
+	}
+	return b
+}
+
+func TestTCPStream(t *testing.T) {
+	query := newBuilder(7, 0x0100, 1, 0)
+	query.name("example", "org")
+	query.question(typeA)
+	response := cnameResponse()
+
+	t.Run("pieces", func(t *testing.T) {
+		// The prefix and the message written separately, then two messages
+		// in one read split inside the second prefix
+		stream := prefixed(query.b, response, query.b)
+		pieces := [][]byte{stream[:1], stream[1:2], stream[2 : 2+len(query.b)], stream[2+len(query.b) : len(stream)-len(query.b)-1], stream[len(stream)-len(query.b)-1:]}
+
+		var s tcpStream
+		var got [][]byte
+		for _, p := range pieces {
+			got = append(got, s.feed(p, 0)...)
+		}
+		want := [][]byte{query.b, response, query.b}
+		if len(got) != len(want) {
+			t.Fatalf("got %d messages, want %d", len(got), len(want))
+		}
+		for i := range want {
+			if !bytes.Equal(got[i], want[i]) {
+				t.Errorf("message %d = %x, want %x", i, got[i], want[i])
+			}
+		}
+	})
+
+	t.Run("gap in a message", func(t *testing.T) {
+		// The end of the response was not captured, the query after it is
+		// still found
+		stream := prefixed(response)
+		cut := len(stream) - 10
+		var s tcpStream
+		got := s.feed(stream[:cut], 10)
+		got = append(got, s.feed(prefixed(query.b), 0)...)
+		if len(got) != 2 || !bytes.Equal(got[0], response[:len(response)-10]) || !bytes.Equal(got[1], query.b) {
+			t.Errorf("got %x", got)
+		}
+	})
+
+	t.Run("bytes after a gap", func(t *testing.T) {
+		stream := prefixed(response)
+		var s tcpStream
+		got := s.feed(stream[:20], 10)
+		got = append(got, s.feed(stream[30:], 0)...)
+		if len(got) != 1 || !bytes.Equal(got[0], response[:18]) {
+			t.Errorf("got %x, want the bytes before the gap", got)
+		}
+	})
+
+	t.Run("gap over a prefix", func(t *testing.T) {
+		stream := prefixed(query.b, query.b)
+		var s tcpStream
+		got := s.feed(stream[:len(query.b)], 4)
+		got = append(got, s.feed(stream[len(query.b)+4:], 0)...)
+		if len(got) != 1 || !bytes.Equal(got[0], query.b[:len(query.b)-2]) {
+			t.Errorf("got %x, want only the first message", got)
+		}
+	})
+}
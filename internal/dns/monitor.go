@@ -0,0 +1,225 @@
+package dns
+
+import (
+	"context"
+	"log/slog"
+	"net/netip"
+	"time"
+
+	"github.com/pedrospdc/gespann/pkg/types"
+)
+
+const (
+	// Queries without a response after this long are reported as timed out.
+	queryTimeout   = 5 * time.Second
+	expireInterval = time.Second
+	maxPending     = 65536
+	maxStreams     = 4096
+)
+
+// queryKey matches a response to its query. Clients in different network
+// namespaces may use the same address.
+type queryKey struct {
+	netns  uint32
+	id     uint16
+	client netip.AddrPort
+	server netip.AddrPort
+}
+
+type pendingQuery struct {
+	pid      uint32
+	nsPID    uint32
+	comm     string
+	protocol types.ProtocolType
+	sent     time.Time
+	seen     time.Time
+	name     string
+	qtype    uint16
+}
+
+// streamKey identifies one direction of a TCP DNS connection.
+type streamKey struct {
+	netns    uint32
+	local    netip.AddrPort
+	remote   netip.AddrPort
+	outbound bool
+}
+
+// openStream is a TCP DNS stream and when it last carried data.
+type openStream struct {
+	tcpStream
+	seen time.Time
+}
+
+// Monitor matches DNS queries with their responses to measure latency and
+// fills the cache with the addresses that were resolved.
+type Monitor struct {
+	cache   *Cache
+	pending map[queryKey]pendingQuery
+	streams map[streamKey]*openStream
+	logger  *slog.Logger
+}
+
+func NewMonitor(cache *Cache, logger *slog.Logger) *Monitor {
+	return &Monitor{
+		cache:   cache,
+		pending: make(map[queryKey]pendingQuery),
+		streams: make(map[streamKey]*openStream),
+		logger:  logger,
+	}
+}
+
+// Run consumes packets until ctx is done, emitting one event per lookup.
+func (m *Monitor) Run(ctx context.Context, packets <-chan types.DNSPacket, events chan<- types.DNSEvent) {
+	ticker := time.NewTicker(expireInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case packet := <-packets:
+			for _, event := range m.receive(packet) {
+				m.send(ctx, events, event)
+			}
+		case now := <-ticker.C:
+			for _, event := range m.expire(now) {
+				m.send(ctx, events, event)
+			}
+			m.cache.prune(now)
+		}
+	}
+}
+
+func (m *Monitor) send(ctx context.Context, events chan<- types.DNSEvent, event types.DNSEvent) {
+	select {
+	case events <- event:
+	case <-ctx.Done():
+	default:
+		m.logger.Warn("DNS event channel full, dropping event")
+	}
+}
+
+// receive handles the messages a packet holds: the datagram itself over
+// UDP, those it completes in its stream over TCP.
+func (m *Monitor) receive(packet types.DNSPacket) []types.DNSEvent {
+	if packet.Protocol != types.ProtoTCP {
+		if event, ok := m.handle(packet, packet.Payload); ok {
+			return []types.DNSEvent{event}
+		}
+		return nil
+	}
+
+	key := streamKey{netns: packet.Netns, local: packet.Local, remote: packet.Remote, outbound: packet.Outbound}
+	stream, ok := m.streams[key]
+	if !ok {
+		if len(m.streams) >= maxStreams {
+			return nil
+		}
+		stream = &openStream{}
+		m.streams[key] = stream
+	}
+	stream.seen = time.Now()
+
+	var events []types.DNSEvent
+	for _, payload := range stream.feed(packet.Payload, packet.Size-len(packet.Payload)) {
+		if event, ok := m.handle(packet, payload); ok {
+			events = append(events, event)
+		}
+	}
+	return events
+}
+
+// handle records a query or completes the lookup a response answers.
+func (m *Monitor) handle(packet types.DNSPacket, payload []byte) (types.DNSEvent, bool) {
+	msg, err := parseMessage(payload)
+	if err != nil {
+		m.logger.Debug("failed to parse DNS message", "error", err)
+		return types.DNSEvent{}, false
+	}
+	if msg.truncated {
+		m.logger.Debug("DNS message cut short, using the records before the cut", "id", msg.id)
+	}
+
+	// The client sends the query and receives the response
+	sender, receiver := packet.Local, packet.Remote
+	if !packet.Outbound {
+		sender, receiver = receiver, sender
+	}
+
+	if !msg.response {
+		key := queryKey{netns: packet.Netns, id: msg.id, client: sender, server: receiver}
+		if _, ok := m.pending[key]; !ok && len(m.pending) >= maxPending {
+			return types.DNSEvent{}, false
+		}
+		m.pending[key] = pendingQuery{
+			pid:      packet.PID,
+			nsPID:    packet.NamespacedPID,
+			comm:     packet.Comm,
+			protocol: packet.Protocol,
+			sent:     packet.Timestamp,
+			seen:     time.Now(),
+			name:     msg.name,
+			qtype:    msg.qtype,
+		}
+		return types.DNSEvent{}, false
+	}
+
+	key := queryKey{netns: packet.Netns, id: msg.id, client: receiver, server: sender}
+	query, ok := m.pending[key]
+	if !ok {
+		return types.DNSEvent{}, false
+	}
+	delete(m.pending, key)
+
+	event := types.DNSEvent{
+		PID:           query.pid,
+		NamespacedPID: query.nsPID,
+		Process:       types.ProcessInfo{Comm: query.comm},
+		Timestamp:     packet.Timestamp,
+		Protocol:      query.protocol,
+		Server:        key.server,
+		Name:          query.name,
+		QType:         query.qtype,
+		RCode:         msg.rcode,
+		Latency:       packet.Timestamp.Sub(query.sent),
+	}
+	for _, a := range msg.answers {
+		// CNAME chains resolve to the name that was asked for
+		m.cache.Add(key.netns, query.name, a.addr, time.Duration(a.ttl)*time.Second)
+		event.Answers = append(event.Answers, a.addr)
+	}
+
+	return event, true
+}
+
+// expire reports queries that got no response within queryTimeout, and
+// forgets TCP streams that were quiet as long.
+func (m *Monitor) expire(now time.Time) []types.DNSEvent {
+	for key, stream := range m.streams {
+		if now.Sub(stream.seen) >= queryTimeout {
+			delete(m.streams, key)
+		}
+	}
+
+	var events []types.DNSEvent
+	for key, query := range m.pending {
+		if now.Sub(query.seen) < queryTimeout {
+			continue
+		}
+		delete(m.pending, key)
+		events = append(events, types.DNSEvent{
+			PID:           query.pid,
+			NamespacedPID: query.nsPID,
+			Process:       types.ProcessInfo{Comm: query.comm},
+			Timestamp:     query.sent,
+			Protocol:      query.protocol,
+			Server:        key.server,
+			Name:          query.name,
+			QType:         query.qtype,
+			TimedOut:      true,
+			Latency:       queryTimeout,
+		})
+	}
+	return events
+}
@@ -0,0 +1,421 @@
+package ebpf
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/cilium/ebpf"
+	"github.com/pedrospdc/gespann/pkg/types"
+	"golang.org/x/sys/unix"
+)
+
+// connState mirrors struct conn_state in conn_tracker.c.
+type connState struct {
+	StartTime     uint64
+	BytesSent     uint64
+	BytesReceived uint64
+	LastRTT       uint32
+	RTTVar        uint32
+	Retransmits   uint32
+	RTOs          uint16
+	LossProbes    uint16
+	LastActivity  uint64
+	TCPState      uint8
+	Direction     uint8
+	_             [2]byte
+	PID           uint32
+	Comm          [taskCommLen]byte
+	CgroupID      uint64
+	NamespacedPID uint32
+	TID           uint32
+}
+
+// udpFlow mirrors struct udp_flow in conn_tracker.c.
+type udpFlow struct {
+	StartTime     uint64
+	LastActivity  uint64
+	BytesSent     uint64
+	BytesReceived uint64
+	PID           uint32
+	Direction     uint8
+	Comm          [taskCommLen]byte
+	_             [3]byte
+	CgroupID      uint64
+	NamespacedPID uint32
+	_             [4]byte
+}
+
+// flowKey identifies a connection or UDP flow, TCP and UDP tuples may overlap.
+type flowKey struct {
+	tuple    connTuple
+	protocol types.ProtocolType
+}
+
+// connCounters are the totals of a connection already reported in CONN_DATA events.
+type connCounters struct {
+	bytesSent     uint64
+	bytesReceived uint64
+	retransmits   uint32
+	rtos          uint16
+	lossProbes    uint16
+}
+
+// delta returns the counters gained since previous. Counters going
+// backwards mean the tuple was reused by a new connection.
+func (c connCounters) delta(previous connCounters) connCounters {
+	if c.bytesSent < previous.bytesSent || c.bytesReceived < previous.bytesReceived ||
+		c.retransmits < previous.retransmits || c.rtos < previous.rtos ||
+		c.lossProbes < previous.lossProbes {
+		return c
+	}
+	return connCounters{
+		bytesSent:     c.bytesSent - previous.bytesSent,
+		bytesReceived: c.bytesReceived - previous.bytesReceived,
+		retransmits:   c.retransmits - previous.retransmits,
+		rtos:          c.rtos - previous.rtos,
+		lossProbes:    c.lossProbes - previous.lossProbes,
+	}
+}
+
+// dataFlusher turns the running totals in conn_state_map and udp_flow_map
+// into CONN_DATA deltas. It remembers what was reported so teardown events
+// only carry the remainder and nothing is counted twice. UDP flows without
+// traffic for udpTimeout are closed here, the kernel never sees them end.
+// TCP connections without traffic for idleThreshold are marked idle here
+// too, the keepalive timer only runs for sockets with SO_KEEPALIVE.
+type dataFlusher struct {
+	states        *ebpf.Map
+	idle          *ebpf.Map
+	udpFlows      *ebpf.Map
+	udpTimeout    time.Duration
+	idleThreshold time.Duration
+
+	mu       sync.Mutex
+	reported map[flowKey]connCounters
+	// departed holds what was reported for connections that left the maps
+	// since the previous flush. Their teardown event may still be in the
+	// ring buffer and has to be settled against it.
+	departed map[flowKey]connCounters
+	// gone holds the start time of conn_state_map entries whose socket was
+	// missing from sock_diag on the previous reconciliation pass.
+	gone map[connTuple]uint64
+}
+
+func newDataFlusher(states, idle, udpFlows *ebpf.Map, udpTimeout, idleThreshold time.Duration) *dataFlusher {
+	return &dataFlusher{
+		states:        states,
+		idle:          idle,
+		udpFlows:      udpFlows,
+		udpTimeout:    udpTimeout,
+		idleThreshold: idleThreshold,
+		reported:      make(map[flowKey]connCounters),
+		departed:      make(map[flowKey]connCounters),
+		gone:          make(map[connTuple]uint64),
+	}
+}
+
+// flush returns a CONN_DATA event for every open connection and UDP flow
+// with traffic since the previous flush, a CONN_IDLE event for every
+// connection that went idle and a CONN_CLOSE event for every UDP flow that
+// timed out.
+func (f *dataFlusher) flush() ([]types.ConnEvent, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	seen := make(map[flowKey]bool, len(f.reported))
+	events, err := f.flushTCP(seen)
+	if err != nil {
+		return events, err
+	}
+	events, err = f.flushUDP(events, seen)
+
+	// Connections departed for a whole interval have had their teardown
+	// event settled or lost it
+	f.departed = make(map[flowKey]connCounters)
+	for key, counters := range f.reported {
+		if !seen[key] {
+			f.departed[key] = counters
+			delete(f.reported, key)
+		}
+	}
+
+	return events, err
+}
+
+func (f *dataFlusher) flushTCP(seen map[flowKey]bool) ([]types.ConnEvent, error) {
+	var (
+		tuple  connTuple
+		state  connState
+		events []types.ConnEvent
+		// last activity of the connections quiet for idleThreshold
+		idle = make(map[connTuple]uint64)
+	)
+	now := time.Now()
+	// conn_state timestamps come from bpf_ktime_get_ns
+	monotonic, err := monotonicNow()
+	if err != nil {
+		return events, err
+	}
+
+	iter := f.states.Iterate()
+	for iter.Next(&tuple, &state) {
+		key := flowKey{tuple, types.ProtoTCP}
+		seen[key] = true
+
+		if f.idleThreshold > 0 && state.LastActivity < monotonic &&
+			monotonic-state.LastActivity >= uint64(f.idleThreshold) {
+			idle[tuple] = state.LastActivity
+		}
+
+		current := connCounters{
+			bytesSent:     state.BytesSent,
+			bytesReceived: state.BytesReceived,
+			retransmits:   state.Retransmits,
+			rtos:          state.RTOs,
+			lossProbes:    state.LossProbes,
+		}
+		previous := f.reported[key]
+		if current == previous {
+			continue
+		}
+		f.reported[key] = current
+		delta := current.delta(previous)
+
+		event := tcpEvent(tuple, &state, types.ConnData, now)
+		event.BytesSent = delta.bytesSent
+		event.BytesReceived = delta.bytesReceived
+		event.Retransmits = delta.retransmits
+		event.RTOs = delta.rtos
+		event.LossProbes = delta.lossProbes
+		events = append(events, event)
+	}
+	if err := iter.Err(); err != nil {
+		return events, err
+	}
+
+	for tuple, lastActivity := range idle {
+		event, ok, err := f.markIdle(tuple, lastActivity, now)
+		if err != nil {
+			return events, err
+		}
+		if ok {
+			events = append(events, event)
+		}
+	}
+
+	return events, nil
+}
+
+// markIdle adds a connection quiet since lastActivity to idle_map, so the
+// kernel reports CONN_ACTIVE on its next packet, and returns its CONN_IDLE
+// event. conn_state is only read, its counters belong to the kernel. When
+// the connection saw traffic or closed before the entry went in, the entry
+// is taken out again.
+func (f *dataFlusher) markIdle(tuple connTuple, lastActivity uint64, now time.Time) (types.ConnEvent, bool, error) {
+	if err := f.idle.Update(tuple, lastActivity, ebpf.UpdateNoExist); err != nil {
+		if errors.Is(err, ebpf.ErrKeyExist) {
+			return types.ConnEvent{}, false, nil
+		}
+		return types.ConnEvent{}, false, fmt.Errorf("failed to mark connection idle: %w", err)
+	}
+
+	var state connState
+	err := f.states.Lookup(tuple, &state)
+	if err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+		return types.ConnEvent{}, false, fmt.Errorf("failed to read connection state: %w", err)
+	}
+	if err != nil || state.LastActivity != lastActivity {
+		// The kernel removed the entry already if it reported the connection active
+		if err := f.idle.Delete(tuple); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+			return types.ConnEvent{}, false, fmt.Errorf("failed to unmark idle connection: %w", err)
+		}
+		return types.ConnEvent{}, false, nil
+	}
+
+	event := tcpEvent(tuple, &state, types.ConnIdle, now)
+	event.Idle = true
+	return event, true, nil
+}
+
+// forget stops tracking a connection, like forget_conn in conn_tracker.c.
+func (f *dataFlusher) forget(tuple connTuple) error {
+	if err := f.states.Delete(tuple); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+		return fmt.Errorf("failed to remove connection state: %w", err)
+	}
+	if err := f.idle.Delete(tuple); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+		return fmt.Errorf("failed to remove idle mark: %w", err)
+	}
+	return nil
+}
+
+// tcpEvent returns an event of type t for a connection in conn_state_map,
+// without counters.
+func tcpEvent(tuple connTuple, state *connState, t types.EventType, now time.Time) types.ConnEvent {
+	return types.ConnEvent{
+		PID:           state.PID,
+		NamespacedPID: state.NamespacedPID,
+		TID:           state.TID,
+		Netns:         tuple.Netns,
+		SAddr:         parseAddr(tuple.Family, tuple.SAddr),
+		DAddr:         parseAddr(tuple.Family, tuple.DAddr),
+		SPort:         tuple.SPort,
+		DPort:         tuple.DPort,
+		Type:          t,
+		Protocol:      types.ProtoTCP,
+		Timestamp:     now,
+		RTTMicros:     state.LastRTT,
+		RTTVarMicros:  state.RTTVar,
+		TCPState:      types.TCPState(state.TCPState),
+		Direction:     types.Direction(state.Direction),
+		Process:       types.ProcessInfo{Comm: cString(state.Comm[:])},
+		Cgroup:        types.CgroupInfo{ID: state.CgroupID},
+	}
+}
+
+func (f *dataFlusher) flushUDP(events []types.ConnEvent, seen map[flowKey]bool) ([]types.ConnEvent, error) {
+	var (
+		tuple   connTuple
+		flow    udpFlow
+		expired []connTuple
+	)
+	now := time.Now()
+	// udp_flow timestamps come from bpf_ktime_get_ns
+	monotonic, err := monotonicNow()
+	if err != nil {
+		return events, err
+	}
+
+	iter := f.udpFlows.Iterate()
+	for iter.Next(&tuple, &flow) {
+		key := flowKey{tuple, types.ProtoUDP}
+
+		current := connCounters{bytesSent: flow.BytesSent, bytesReceived: flow.BytesReceived}
+		previous := f.reported[key]
+		timedOut := flow.LastActivity < monotonic && monotonic-flow.LastActivity >= uint64(f.udpTimeout)
+
+		event := types.ConnEvent{
+			PID:           flow.PID,
+			NamespacedPID: flow.NamespacedPID,
+			Netns:         tuple.Netns,
+			SAddr:         parseAddr(tuple.Family, tuple.SAddr),
+			DAddr:         parseAddr(tuple.Family, tuple.DAddr),
+			SPort:         tuple.SPort,
+			DPort:         tuple.DPort,
+			Type:          types.ConnData,
+			Protocol:      types.ProtoUDP,
+			Timestamp:     now,
+			Direction:     types.Direction(flow.Direction),
+			Process:       types.ProcessInfo{Comm: cString(flow.Comm[:])},
+			Cgroup:        types.CgroupInfo{ID: flow.CgroupID},
+		}
+
+		if timedOut {
+			expired = append(expired, tuple)
+			delete(f.reported, key)
+			event.Type = types.ConnClose
+			event.DurationMS = uint32((flow.LastActivity - flow.StartTime) / uint64(time.Millisecond))
+		} else {
+			seen[key] = true
+			if current == previous {
+				continue
+			}
+			f.reported[key] = current
+		}
+
+		delta := current.delta(previous)
+		event.BytesSent = delta.bytesSent
+		event.BytesReceived = delta.bytesReceived
+		events = append(events, event)
+	}
+	if err := iter.Err(); err != nil {
+		return events, err
+	}
+
+	for _, tuple := range expired {
+		if err := f.udpFlows.Delete(tuple); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+			return events, fmt.Errorf("failed to remove UDP flow: %w", err)
+		}
+	}
+
+	return events, nil
+}
+
+// monotonicNow returns CLOCK_MONOTONIC in nanoseconds, the clock of bpf_ktime_get_ns.
+func monotonicNow() (uint64, error) {
+	var ts unix.Timespec
+	if err := unix.ClockGettime(unix.CLOCK_MONOTONIC, &ts); err != nil {
+		return 0, fmt.Errorf("failed to read monotonic clock: %w", err)
+	}
+	return uint64(ts.Nano()), nil
+}
+
+// settle subtracts the totals already reported for a TCP connection from
+// its teardown event and forgets the connection.
+func (f *dataFlusher) settle(key connTuple, event *types.ConnEvent) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	k := flowKey{key, types.ProtoTCP}
+	reported, ok := f.reported[k]
+	if !ok {
+		reported, ok = f.departed[k]
+	}
+	if !ok {
+		return
+	}
+	delete(f.reported, k)
+	delete(f.departed, k)
+
+	event.BytesSent = remaining(event.BytesSent, reported.bytesSent)
+	event.BytesReceived = remaining(event.BytesReceived, reported.bytesReceived)
+	event.Retransmits = remaining(event.Retransmits, reported.retransmits)
+	event.RTOs = remaining(event.RTOs, reported.rtos)
+	event.LossProbes = remaining(event.LossProbes, reported.lossProbes)
+}
+
+// remaining returns the part of total not reported yet.
+func remaining[T uint16 | uint32 | uint64](total, reported T) T {
+	if total < reported {
+		return 0
+	}
+	return total - reported
+}
+
+// isTeardown reports whether an event ends a tracked connection.
+func isTeardown(t types.EventType) bool {
+	return t == types.ConnClose || t == types.ConnReset || t == types.ConnFailed
+}
+
+// reportData emits CONN_DATA events for open connections every dataInterval.
+func (t *Tracker) reportData(ctx context.Context, eventCh chan<- types.ConnEvent) {
+	ticker := time.NewTicker(t.dataInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			events, err := t.flusher.flush()
+			if err != nil {
+				t.logger.Warn("failed to read connection state", "error", err)
+			}
+
+			for _, event := range events {
+				if !t.traced(event.Netns) {
+					continue
+				}
+				select {
+				case eventCh <- event:
+				case <-ctx.Done():
+					return
+				default:
+					t.logger.Warn("event channel full, dropping event")
+				}
+			}
+		}
+	}
+}
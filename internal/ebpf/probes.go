@@ -0,0 +1,270 @@
+package ebpf
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/link"
+	"github.com/pedrospdc/gespann/pkg/types"
+)
+
+const kallsymsPath = "/proc/kallsyms"
+
+var tracefsPaths = []string{"/sys/kernel/tracing", "/sys/kernel/debug/tracing"}
+
+type probeKind uint8
+
+const (
+	kprobe probeKind = iota
+	kretprobe
+	tracepoint
+	uprobe
+	uretprobe
+)
+
+// defaultResolverLibraries are the usual glibc and musl locations.
+var defaultResolverLibraries = []string{
+	"/lib/x86_64-linux-gnu/libc.so.6",
+	"/lib/aarch64-linux-gnu/libc.so.6",
+	"/lib64/libc.so.6",
+	"/usr/lib/libc.so.6",
+	"/lib/ld-musl-x86_64.so.1",
+	"/lib/ld-musl-aarch64.so.1",
+}
+
+// probe is a kernel or user space hook. For tracepoints symbol is
+// "group/name", for uprobes "library:function".
+type probe struct {
+	kind     probeKind
+	symbol   string
+	prog     *ebpf.Program
+	required bool
+}
+
+// name identifies the probe in reports, e.g. "kretprobe/tcp_close".
+func (p probe) name() string {
+	switch p.kind {
+	case kretprobe:
+		return "kretprobe/" + p.symbol
+	case tracepoint:
+		return "tracepoint/" + p.symbol
+	case uprobe:
+		return "uprobe/" + p.symbol
+	case uretprobe:
+		return "uretprobe/" + p.symbol
+	default:
+		return "kprobe/" + p.symbol
+	}
+}
+
+// userSymbol splits a uprobe symbol into library path and function.
+func (p probe) userSymbol() (string, string) {
+	i := strings.LastIndex(p.symbol, ":")
+	return p.symbol[:i], p.symbol[i+1:]
+}
+
+func (p probe) attach() (link.Link, error) {
+	switch p.kind {
+	case kretprobe:
+		return link.Kretprobe(p.symbol, p.prog, nil)
+	case tracepoint:
+		group, name, _ := strings.Cut(p.symbol, "/")
+		return link.Tracepoint(group, name, p.prog, nil)
+	case uprobe, uretprobe:
+		path, symbol := p.userSymbol()
+		ex, err := link.OpenExecutable(path)
+		if err != nil {
+			return nil, err
+		}
+		if p.kind == uretprobe {
+			return ex.Uretprobe(symbol, p.prog, nil)
+		}
+		return ex.Uprobe(symbol, p.prog, nil)
+	default:
+		return link.Kprobe(p.symbol, p.prog, nil)
+	}
+}
+
+// Capabilities reports which program set was loaded and the state of each probe.
+type Capabilities struct {
+	Requested string              `json:"requested"`
+	Program   string              `json:"program"`
+	Probes    []types.ProbeStatus `json:"probes"`
+}
+
+// ActiveProbes returns the names of all attached probes.
+func (c Capabilities) ActiveProbes() []string {
+	return c.probesIn(types.ProbeAttached)
+}
+
+// MissingProbes returns the names of probes that are unavailable or failed to attach.
+func (c Capabilities) MissingProbes() []string {
+	return append(c.probesIn(types.ProbeUnavailable), c.probesIn(types.ProbeFailed)...)
+}
+
+func (c Capabilities) probesIn(state types.ProbeState) []string {
+	var names []string
+	for _, p := range c.Probes {
+		if p.State == state {
+			names = append(names, p.Name)
+		}
+	}
+	return names
+}
+
+// fullProbes maps the conn_tracker.c programs to the kernel functions they
+// hook. Called with empty objects it yields the symbols needed for probing.
+// Only the connection lifecycle is required; everything else adds detail.
+func fullProbes(objs *ConnTrackerObjects) []probe {
+	return []probe{
+		{kprobe, "tcp_connect", objs.TraceTcpConnect, true},
+		{kprobe, "tcp_close", objs.TraceTcpClose, true},
+		{kretprobe, "tcp_close", objs.TraceTcpCloseRet, true},
+		{kretprobe, "inet_csk_accept", objs.TraceInetCskAccept, false},
+		{kprobe, "tcp_rcv_established", objs.TraceTcpRcvEstablished, false},
+		{tracepoint, "tcp/tcp_retransmit_skb", objs.TraceTcpRetransmitSkb, false},
+		{kprobe, "tcp_retransmit_timer", objs.TraceTcpRetransmitTimer, false},
+		{kprobe, "tcp_send_loss_probe", objs.TraceTcpSendLossProbe, false},
+		{kprobe, "tcp_sendmsg", objs.TraceTcpSendmsg, false},
+		{kprobe, "tcp_recvmsg", objs.TraceTcpRecvmsg, false},
+		{kretprobe, "tcp_recvmsg", objs.TraceTcpRecvmsgRet, false},
+		{kprobe, "tcp_reset", objs.TraceTcpReset, false},
+		{kprobe, "tcp_send_active_reset", objs.TraceTcpSendActiveReset, false},
+		{tracepoint, "tcp/tcp_send_reset", objs.TraceTcpSendReset, false},
+		{kprobe, "tcp_write_err", objs.TraceTcpWriteErr, false},
+		{kprobe, "tcp_keepalive_timer", objs.TraceTcpKeepalive, false},
+		{tracepoint, "sock/inet_sock_set_state", objs.TraceInetSockSetState, false},
+		{kprobe, "udp_sendmsg", objs.TraceUdpSendmsg, false},
+		{kretprobe, "udp_sendmsg", objs.TraceUdpSendmsgRet, false},
+		{kprobe, "udpv6_sendmsg", objs.TraceUdpSendmsg, false},
+		{kretprobe, "udpv6_sendmsg", objs.TraceUdpSendmsgRet, false},
+		{kprobe, "udp_recvmsg", objs.TraceUdpRecvmsg, false},
+		{kretprobe, "udp_recvmsg", objs.TraceUdpRecvmsgRet, false},
+		{kprobe, "udpv6_recvmsg", objs.TraceUdpRecvmsg, false},
+		{kretprobe, "udpv6_recvmsg", objs.TraceUdpRecvmsgRet, false},
+		{kprobe, "udp_send_skb", objs.TraceUdpSendSkb, false},
+		{kprobe, "udp_v6_send_skb", objs.TraceUdpSendSkb, false},
+		{kprobe, "skb_consume_udp", objs.TraceSkbConsumeUdp, false},
+		{tracepoint, "sched/sched_process_exit", objs.TraceSchedProcessExit, false},
+	}
+}
+
+// resolverProbes hooks getaddrinfo in each resolver library that exists.
+func resolverProbes(objs *ConnTrackerObjects, libraries []string) []probe {
+	if len(libraries) == 0 {
+		libraries = defaultResolverLibraries
+	}
+
+	var probes []probe
+	for _, path := range libraries {
+		if _, err := os.Stat(path); err != nil {
+			continue
+		}
+		probes = append(probes,
+			probe{uprobe, path + ":getaddrinfo", objs.TraceGetaddrinfo, false},
+			probe{uretprobe, path + ":getaddrinfo", objs.TraceGetaddrinfoRet, false},
+		)
+	}
+	return probes
+}
+
+// programProbes returns the probes of the full program set for config.
+func programProbes(objs *ConnTrackerObjects, config Config) []probe {
+	probes := fullProbes(objs)
+	if config.ResolverUprobes {
+		probes = append(probes, resolverProbes(objs, config.ResolverLibraries)...)
+	}
+	return probes
+}
+
+func simpleProbes(objs *SimpleTrackerObjects) []probe {
+	return []probe{
+		{kprobe, "tcp_connect", objs.TraceTcpConnect, true},
+		{kprobe, "tcp_close", objs.TraceTcpClose, true},
+	}
+}
+
+// kernelSymbols reads the subset of wanted symbols present in /proc/kallsyms.
+func kernelSymbols(wanted []string) (map[string]bool, error) {
+	f, err := os.Open(kallsymsPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", kallsymsPath, err)
+	}
+	defer f.Close()
+
+	want := make(map[string]bool, len(wanted))
+	for _, s := range wanted {
+		want[s] = true
+	}
+
+	found := make(map[string]bool, len(wanted))
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// Format: <address> <type> <symbol> [module]
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 {
+			continue
+		}
+		if want[fields[2]] {
+			found[fields[2]] = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", kallsymsPath, err)
+	}
+
+	return found, nil
+}
+
+func probeStatus(p probe, state types.ProbeState) types.ProbeStatus {
+	return types.ProbeStatus{Name: p.name(), Required: p.required, State: state}
+}
+
+// probeAvailability reports which probes the running kernel supports, using
+// /proc/kallsyms for kprobes and tracefs for tracepoints. Uprobes only need
+// their library to exist.
+func probeAvailability(probes []probe) (map[string]bool, error) {
+	var symbols []string
+	for _, p := range probes {
+		if p.kind == kprobe || p.kind == kretprobe {
+			symbols = append(symbols, p.symbol)
+		}
+	}
+
+	found, err := kernelSymbols(symbols)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, p := range probes {
+		switch p.kind {
+		case tracepoint:
+			exists, err := tracepointExists(p.symbol)
+			if err != nil {
+				return nil, err
+			}
+			found[p.symbol] = exists
+		case uprobe, uretprobe:
+			path, _ := p.userSymbol()
+			_, err := os.Stat(path)
+			found[p.symbol] = err == nil
+		}
+	}
+
+	return found, nil
+}
+
+func tracepointExists(name string) (bool, error) {
+	for _, root := range tracefsPaths {
+		if _, err := os.Stat(filepath.Join(root, "events")); err != nil {
+			continue
+		}
+		_, err := os.Stat(filepath.Join(root, "events", name))
+		return err == nil, nil
+	}
+	return false, fmt.Errorf("tracefs not mounted at any of %v", tracefsPaths)
+}
@@ -0,0 +1,216 @@
+package ebpf
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/cilium/ebpf"
+	"github.com/pedrospdc/gespann/pkg/types"
+)
+
+// Connections returns the connections tracked in conn_state_map and
+// udp_flow_map with their direction, for reconciling the userspace view.
+// The simple program set tracks none.
+//
+// conn_state_map is checked against the sockets sock_diag lists. An entry
+// whose socket is gone is left out, and removed from the map once the next
+// pass finds it gone too, its teardown was never traced. Namespaces that
+// can not be listed are taken as the map has them. The same listing counts
+// the TCP sockets by state.
+func (t *Tracker) Connections() (types.KernelConnections, error) {
+	if t.flusher == nil {
+		return types.KernelConnections{}, errors.New("the simple program set does not track connections")
+	}
+
+	// The map is read before the sockets are listed, so a connection
+	// made in between is not taken as gone
+	tcp, err := t.flusher.tcpStates(t.traced)
+	if err != nil {
+		return types.KernelConnections{}, err
+	}
+	open, listed, counts := t.listSockets()
+
+	conns := make(map[types.ConnKey]types.Direction, len(tcp))
+	gone := make(map[connTuple]uint64)
+	for tuple, state := range tcp {
+		if listed[tuple.Netns] && !open[tuple] {
+			gone[tuple] = state.StartTime
+			continue
+		}
+		conns[tuple.key(types.ProtoTCP)] = types.Direction(state.Direction)
+	}
+
+	removed, err := t.flusher.removeGone(gone)
+	if removed > 0 {
+		t.logger.Info("removed connection state of closed sockets", "count", removed)
+	}
+	if err != nil {
+		return types.KernelConnections{}, err
+	}
+
+	if err := t.flusher.udpConnections(t.traced, conns); err != nil {
+		return types.KernelConnections{}, err
+	}
+	return types.KernelConnections{Open: conns, TCPStates: counts}, nil
+}
+
+// tcpStateKey mirrors struct tcp_state_key in conn_tracker.c.
+type tcpStateKey struct {
+	Netns uint32
+	State uint32
+}
+
+// TCPStateMoves returns, by TCP state, how many sockets of the traced
+// network namespaces entered it minus how many left it since the probes
+// were attached. TCP_CLOSE is not counted.
+func (t *Tracker) TCPStateMoves() (map[types.TCPState]int64, error) {
+	if t.tcpStateCounts == nil {
+		return nil, errors.New("the simple program set does not count TCP states")
+	}
+
+	var (
+		key    tcpStateKey
+		counts []int64
+	)
+	moves := make(map[types.TCPState]int64)
+	iter := t.tcpStateCounts.Iterate()
+	for iter.Next(&key, &counts) {
+		if !t.traced(key.Netns) {
+			continue
+		}
+		for _, count := range counts {
+			moves[types.TCPState(key.State)] += count
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read TCP state counts: %w", err)
+	}
+	return moves, nil
+}
+
+// listSockets lists the TCP sockets of the traced network namespaces.
+// listed holds the namespaces that could be listed. counts holds the
+// sockets in countedStates, it is nil unless every namespace was listed.
+// Namespaces without a process in them can not be entered and are skipped.
+func (t *Tracker) listSockets() (open map[connTuple]bool, listed map[uint32]bool, counts map[types.TCPState]int64) {
+	open = make(map[connTuple]bool)
+	listed = make(map[uint32]bool)
+
+	namespaces, err := netnsPaths()
+	if err != nil {
+		t.logger.Debug("failed to find network namespaces", "error", err)
+		return open, listed, nil
+	}
+
+	counts = make(map[types.TCPState]int64, len(countedStates))
+	for _, state := range countedStates {
+		counts[state] = 0
+	}
+	for netns, path := range namespaces {
+		if !t.traced(netns) {
+			continue
+		}
+		conns, err := dumpTCP(path, trackedStates)
+		if err != nil {
+			t.logger.Debug("failed to list connections", "netns", netns, "error", err)
+			counts = nil
+			continue
+		}
+		listed[netns] = true
+		for _, conn := range conns {
+			open[conn.tuple(netns)] = true
+			if counts != nil {
+				if _, ok := counts[types.TCPState(conn.msg.State)]; ok {
+					counts[types.TCPState(conn.msg.State)]++
+				}
+			}
+		}
+	}
+	return open, listed, counts
+}
+
+// tcpStates reads the conn_state_map entries of traced namespaces.
+func (f *dataFlusher) tcpStates(traced func(netns uint32) bool) (map[connTuple]connState, error) {
+	var (
+		tuple connTuple
+		state connState
+	)
+	states := make(map[connTuple]connState)
+
+	iter := f.states.Iterate()
+	for iter.Next(&tuple, &state) {
+		if traced(tuple.Netns) {
+			states[tuple] = state
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read connection state: %w", err)
+	}
+	return states, nil
+}
+
+// removeGone deletes the entries found gone on this pass and the previous
+// one, and remembers the rest for the next pass. The start time tells a
+// connection made on the same tuple since apart, it is kept.
+func (f *dataFlusher) removeGone(gone map[connTuple]uint64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	previous := f.gone
+	f.gone = make(map[connTuple]uint64)
+
+	removed := 0
+	for tuple, startTime := range gone {
+		if previous[tuple] != startTime {
+			f.gone[tuple] = startTime
+			continue
+		}
+
+		var state connState
+		if err := f.states.Lookup(tuple, &state); err != nil {
+			if errors.Is(err, ebpf.ErrKeyNotExist) {
+				continue
+			}
+			return removed, fmt.Errorf("failed to read connection state: %w", err)
+		}
+		if state.StartTime != startTime {
+			continue
+		}
+		if err := f.forget(tuple); err != nil {
+			return removed, err
+		}
+		delete(f.reported, flowKey{tuple, types.ProtoTCP})
+		removed++
+	}
+	return removed, nil
+}
+
+// udpConnections adds the flows of traced namespaces in udp_flow_map to conns.
+func (f *dataFlusher) udpConnections(traced func(netns uint32) bool, conns map[types.ConnKey]types.Direction) error {
+	var (
+		tuple connTuple
+		flow  udpFlow
+	)
+
+	iter := f.udpFlows.Iterate()
+	for iter.Next(&tuple, &flow) {
+		if traced(tuple.Netns) {
+			conns[tuple.key(types.ProtoUDP)] = types.Direction(flow.Direction)
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return fmt.Errorf("failed to read UDP flows: %w", err)
+	}
+	return nil
+}
+
+func (t connTuple) key(protocol types.ProtocolType) types.ConnKey {
+	return types.ConnKey{
+		Netns:    t.Netns,
+		Protocol: protocol,
+		SAddr:    parseAddr(t.Family, t.SAddr),
+		DAddr:    parseAddr(t.Family, t.DAddr),
+		SPort:    t.SPort,
+		DPort:    t.DPort,
+	}
+}
@@ -0,0 +1,612 @@
+package ebpf
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/cilium/ebpf"
+	"github.com/pedrospdc/gespann/internal/procfs"
+	"github.com/pedrospdc/gespann/pkg/types"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// sockDiagByFamily is SOCK_DIAG_BY_FAMILY, inetDiagInfo INET_DIAG_INFO.
+	sockDiagByFamily = 20
+	inetDiagInfo     = 2
+)
+
+// snapshotStates are the TCP states of connections the probes would be
+// tracking had they been attached when the connection was made. Listening
+// sockets tell inbound connections apart.
+var snapshotStates = []types.TCPState{types.TCPEstablished, types.TCPSynSent, types.TCPCloseWait, types.TCPListen}
+
+// trackedStates are the TCP states of sockets conn_state_map may hold an
+// entry for, and of listening sockets. The probes remove the entry when the
+// socket enters TCP_CLOSE.
+var trackedStates = []types.TCPState{
+	types.TCPEstablished, types.TCPSynSent, types.TCPSynRecv, types.TCPFinWait1,
+	types.TCPFinWait2, types.TCPCloseWait, types.TCPLastAck, types.TCPClosing,
+	types.TCPListen,
+}
+
+// countedStates are the TCP states whose sockets are counted for the state
+// gauges. sock_diag lists pending handshakes as SYN_RECV, the probes only
+// see a socket in SYN_RECV while it is being accepted, so it is left out.
+// So are TIME_WAIT and NEW_SYN_RECV, sockets never enter them through
+// inet_sock_set_state.
+var countedStates = []types.TCPState{
+	types.TCPEstablished, types.TCPSynSent, types.TCPFinWait1, types.TCPFinWait2,
+	types.TCPCloseWait, types.TCPLastAck, types.TCPClosing, types.TCPListen,
+}
+
+// inetDiagSockID mirrors struct inet_diag_sockid. Ports are big endian.
+type inetDiagSockID struct {
+	SPort  [2]byte
+	DPort  [2]byte
+	Src    [16]byte
+	Dst    [16]byte
+	If     uint32
+	Cookie [2]uint32
+}
+
+// inetDiagReq mirrors struct inet_diag_req_v2.
+type inetDiagReq struct {
+	Family   uint8
+	Protocol uint8
+	Ext      uint8
+	_        uint8
+	States   uint32
+	ID       inetDiagSockID
+}
+
+// inetDiagMsg mirrors struct inet_diag_msg.
+type inetDiagMsg struct {
+	Family  uint8
+	State   uint8
+	Timer   uint8
+	Retrans uint8
+	ID      inetDiagSockID
+	Expires uint32
+	RQueue  uint32
+	WQueue  uint32
+	UID     uint32
+	Inode   uint32
+}
+
+// tcpInfo mirrors struct tcp_info up to the byte counters.
+type tcpInfo struct {
+	_             [8]byte
+	_             [15]uint32
+	RTT           uint32
+	RTTVar        uint32
+	_             [7]uint32
+	_             [2]uint64
+	BytesAcked    uint64
+	BytesReceived uint64
+}
+
+// socketOwner is the process holding a socket open.
+type socketOwner struct {
+	pid      uint32
+	nsPID    uint32
+	comm     [taskCommLen]byte
+	cgroupID uint64
+}
+
+// reportExisting seeds conn_state_map and the data flusher with the TCP
+// connections that were open before the probes were attached, and reports
+// them as CONN_EXISTING so userspace counts them open. Without it their
+// teardown would be missed, and their first CONN_DATA would carry every
+// byte since the connection was made. Their duration counts from now, the
+// kernel does not keep when a connection was made.
+func (t *Tracker) reportExisting(ctx context.Context, eventCh chan<- types.ConnEvent) {
+	events, err := t.snapshot()
+	if err != nil {
+		t.logger.Warn("failed to snapshot existing connections", "error", err)
+	}
+	t.logger.Info("existing connections found", "count", len(events))
+
+	for _, event := range events {
+		select {
+		case eventCh <- event:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// snapshot lists the connections of every traced network namespace and
+// seeds the ones not tracked yet. A connection closed between listing and
+// seeding would leave its seed behind for good, the probes saw nothing to
+// remove it on, so the namespace is listed again and such seeds are dropped.
+func (t *Tracker) snapshot() ([]types.ConnEvent, error) {
+	namespaces, owners, err := scanProcesses()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	monotonic, err := monotonicNow()
+	if err != nil {
+		return nil, err
+	}
+
+	var events []types.ConnEvent
+	for netns, path := range namespaces {
+		if !t.traced(netns) {
+			continue
+		}
+
+		conns, err := dumpTCP(path, snapshotStates)
+		if err != nil {
+			t.logger.Debug("failed to list connections", "netns", netns, "error", err)
+			continue
+		}
+
+		listening := make(map[[2]byte]bool)
+		for _, conn := range conns {
+			if types.TCPState(conn.msg.State) == types.TCPListen {
+				listening[conn.msg.ID.SPort] = true
+			}
+		}
+
+		seeded := make(map[connTuple]types.ConnEvent)
+		for _, conn := range conns {
+			if types.TCPState(conn.msg.State) == types.TCPListen {
+				continue
+			}
+
+			tuple := conn.tuple(netns)
+			direction := types.DirectionOutbound
+			if listening[conn.msg.ID.SPort] {
+				direction = types.DirectionInbound
+			}
+			owner := owners[conn.msg.Inode]
+
+			state := connState{
+				StartTime:     monotonic,
+				BytesSent:     conn.info.BytesAcked,
+				BytesReceived: conn.info.BytesReceived,
+				LastRTT:       conn.info.RTT,
+				RTTVar:        conn.info.RTTVar,
+				LastActivity:  monotonic,
+				TCPState:      conn.msg.State,
+				Direction:     uint8(direction),
+				PID:           owner.pid,
+				TID:           owner.pid,
+				Comm:          owner.comm,
+				CgroupID:      owner.cgroupID,
+				NamespacedPID: owner.nsPID,
+			}
+			ok, err := t.flusher.seed(tuple, state)
+			if err != nil {
+				return events, err
+			}
+			// Connections made since the probes were attached are tracked already
+			if !ok {
+				continue
+			}
+
+			seeded[tuple] = types.ConnEvent{
+				PID:           owner.pid,
+				NamespacedPID: owner.nsPID,
+				Netns:         netns,
+				SAddr:         parseAddr(tuple.Family, tuple.SAddr),
+				DAddr:         parseAddr(tuple.Family, tuple.DAddr),
+				SPort:         tuple.SPort,
+				DPort:         tuple.DPort,
+				Type:          types.ConnExisting,
+				Protocol:      types.ProtoTCP,
+				Timestamp:     now,
+				TCPState:      types.TCPState(conn.msg.State),
+				Direction:     direction,
+				Process:       types.ProcessInfo{Comm: cString(owner.comm[:])},
+				Cgroup:        types.CgroupInfo{ID: owner.cgroupID},
+			}
+		}
+		if len(seeded) == 0 {
+			continue
+		}
+
+		open, err := dumpTCP(path, snapshotStates)
+		if err != nil {
+			// The seeds are kept, reconciliation removes those left behind
+			t.logger.Debug("failed to list connections again", "netns", netns, "error", err)
+			for _, event := range seeded {
+				events = append(events, event)
+			}
+			continue
+		}
+		remaining := make(map[connTuple]bool, len(open))
+		for _, conn := range open {
+			remaining[conn.tuple(netns)] = true
+		}
+		for tuple, event := range seeded {
+			if remaining[tuple] {
+				events = append(events, event)
+				continue
+			}
+			if err := t.flusher.unseed(tuple, monotonic); err != nil {
+				return events, err
+			}
+		}
+	}
+
+	return events, nil
+}
+
+// scanProcesses walks /proc for a process in every network namespace, by
+// namespace inode, and for the process owning every socket, by socket inode.
+func scanProcesses() (map[uint32]string, map[uint32]socketOwner, error) {
+	entries, err := os.ReadDir(procfs.Path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to list processes: %w", err)
+	}
+
+	namespaces := make(map[uint32]string)
+	owners := make(map[uint32]socketOwner)
+	// Without cgroup v2 the owners' cgroup IDs are left zero
+	cgroupRoot, _ := procfs.CgroupRoot()
+
+	for _, entry := range entries {
+		pid, err := strconv.ParseUint(entry.Name(), 10, 32)
+		if err != nil {
+			continue
+		}
+		dir := filepath.Join(procfs.Path, entry.Name())
+
+		// Processes exit while walking, whatever can not be read is skipped
+		if netns, path, ok := processNetns(dir); ok {
+			if _, ok := namespaces[netns]; !ok {
+				namespaces[netns] = path
+			}
+		}
+
+		fds, err := os.ReadDir(filepath.Join(dir, "fd"))
+		if err != nil {
+			continue
+		}
+		var owner *socketOwner
+		for _, fd := range fds {
+			link, err := os.Readlink(filepath.Join(dir, "fd", fd.Name()))
+			if err != nil {
+				continue
+			}
+			inode, ok := socketInode(link)
+			if !ok {
+				continue
+			}
+			if _, ok := owners[inode]; ok {
+				continue
+			}
+			if owner == nil {
+				owner = &socketOwner{pid: uint32(pid), cgroupID: cgroupID(cgroupRoot, dir)}
+				_, owner.nsPID = procfs.ReadStatus(filepath.Join(dir, "status"))
+				if comm, err := os.ReadFile(filepath.Join(dir, "comm")); err == nil {
+					copy(owner.comm[:taskCommLen-1], bytes.TrimSpace(comm))
+				}
+			}
+			owners[inode] = *owner
+		}
+	}
+
+	return namespaces, owners, nil
+}
+
+// netnsPaths walks /proc for a process in every network namespace, by
+// namespace inode.
+func netnsPaths() (map[uint32]string, error) {
+	entries, err := os.ReadDir(procfs.Path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list processes: %w", err)
+	}
+
+	namespaces := make(map[uint32]string)
+	for _, entry := range entries {
+		if _, err := strconv.ParseUint(entry.Name(), 10, 32); err != nil {
+			continue
+		}
+		netns, path, ok := processNetns(filepath.Join(procfs.Path, entry.Name()))
+		if !ok {
+			continue
+		}
+		if _, ok := namespaces[netns]; !ok {
+			namespaces[netns] = path
+		}
+	}
+	return namespaces, nil
+}
+
+// processNetns returns the network namespace inode of the process at dir
+// and the path to open it by.
+func processNetns(dir string) (uint32, string, bool) {
+	path := filepath.Join(dir, "ns", "net")
+	var st unix.Stat_t
+	if err := unix.Stat(path, &st); err != nil {
+		return 0, "", false
+	}
+	return uint32(st.Ino), path, true
+}
+
+// socketInode parses the "socket:[<inode>]" target of a socket descriptor.
+func socketInode(link string) (uint32, bool) {
+	s, ok := strings.CutPrefix(link, "socket:[")
+	if !ok {
+		return 0, false
+	}
+	inode, err := strconv.ParseUint(strings.TrimSuffix(s, "]"), 10, 32)
+	return uint32(inode), err == nil
+}
+
+// cgroupID returns the ID of a process's cgroup v2, the inode of its
+// directory, as bpf_get_current_cgroup_id does. Zero when unknown.
+func cgroupID(root, dir string) uint64 {
+	if root == "" {
+		return 0
+	}
+	f, err := os.Open(filepath.Join(dir, "cgroup"))
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		path, ok := strings.CutPrefix(scanner.Text(), "0::")
+		if !ok {
+			continue
+		}
+		var st unix.Stat_t
+		if err := unix.Stat(filepath.Join(root, path), &st); err != nil {
+			return 0
+		}
+		return st.Ino
+	}
+	return 0
+}
+
+// diagConn is a socket as reported by sock_diag with its tcp_info.
+type diagConn struct {
+	msg  inetDiagMsg
+	info tcpInfo
+}
+
+// tuple returns the conn_state_map key of the socket in network namespace netns.
+func (c diagConn) tuple(netns uint32) connTuple {
+	return connTuple{
+		SAddr:  c.msg.ID.Src,
+		DAddr:  c.msg.ID.Dst,
+		SPort:  binary.BigEndian.Uint16(c.msg.ID.SPort[:]),
+		DPort:  binary.BigEndian.Uint16(c.msg.ID.DPort[:]),
+		Family: uint16(c.msg.Family),
+		Netns:  netns,
+	}
+}
+
+// dumpTCP lists the TCP sockets in states of the network namespace at
+// path, IPv4 and IPv6.
+func dumpTCP(path string, states []types.TCPState) ([]diagConn, error) {
+	fd, err := sockDiagSocket(path)
+	if err != nil {
+		return nil, err
+	}
+	defer unix.Close(fd)
+
+	var mask uint32
+	for _, state := range states {
+		mask |= 1 << state
+	}
+
+	var conns []diagConn
+	for _, family := range []uint8{afInet, afInet6} {
+		req := inetDiagReq{
+			Family:   family,
+			Protocol: unix.IPPROTO_TCP,
+			Ext:      1 << (inetDiagInfo - 1),
+			States:   mask,
+		}
+		conns, err = dumpFamily(fd, req, conns)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return conns, nil
+}
+
+// dumpFamily sends a sock_diag dump request and collects the replies.
+func dumpFamily(fd int, req inetDiagReq, conns []diagConn) ([]diagConn, error) {
+	var buf bytes.Buffer
+	header := unix.NlMsghdr{
+		Len:   uint32(unix.SizeofNlMsghdr + binary.Size(req)),
+		Type:  sockDiagByFamily,
+		Flags: unix.NLM_F_REQUEST | unix.NLM_F_DUMP,
+		Seq:   1,
+	}
+	binary.Write(&buf, binary.LittleEndian, header)
+	binary.Write(&buf, binary.LittleEndian, req)
+	if err := unix.Sendto(fd, buf.Bytes(), 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return nil, fmt.Errorf("failed to send sock_diag request: %w", err)
+	}
+
+	rb := make([]byte, 64*1024)
+	for {
+		n, _, err := unix.Recvfrom(fd, rb, 0)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read sock_diag reply: %w", err)
+		}
+		msgs, err := syscall.ParseNetlinkMessage(rb[:n])
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse sock_diag reply: %w", err)
+		}
+
+		for _, m := range msgs {
+			switch m.Header.Type {
+			case unix.NLMSG_DONE:
+				return conns, nil
+			case unix.NLMSG_ERROR:
+				if len(m.Data) >= 4 {
+					if errno := int32(binary.LittleEndian.Uint32(m.Data)); errno != 0 {
+						return nil, fmt.Errorf("sock_diag request failed: %w", syscall.Errno(-errno))
+					}
+				}
+				return conns, nil
+			case sockDiagByFamily:
+				conn, err := parseDiagConn(m.Data)
+				if err != nil {
+					return nil, err
+				}
+				conns = append(conns, conn)
+			}
+		}
+	}
+}
+
+// parseDiagConn decodes an inet_diag_msg and the tcp_info attribute that
+// follows it. Older kernels send a shorter tcp_info, the missing fields are
+// left zero.
+func parseDiagConn(data []byte) (diagConn, error) {
+	var conn diagConn
+	size := binary.Size(conn.msg)
+	if len(data) < size {
+		return conn, errors.New("truncated sock_diag message")
+	}
+	if err := binary.Read(bytes.NewReader(data), binary.LittleEndian, &conn.msg); err != nil {
+		return conn, fmt.Errorf("failed to parse sock_diag message: %w", err)
+	}
+
+	attrs := data[size:]
+	for len(attrs) >= unix.SizeofRtAttr {
+		length := int(binary.LittleEndian.Uint16(attrs))
+		kind := binary.LittleEndian.Uint16(attrs[2:])
+		if length < unix.SizeofRtAttr || length > len(attrs) {
+			break
+		}
+		if kind == inetDiagInfo {
+			info := make([]byte, binary.Size(conn.info))
+			copy(info, attrs[unix.SizeofRtAttr:length])
+			if err := binary.Read(bytes.NewReader(info), binary.LittleEndian, &conn.info); err != nil {
+				return conn, fmt.Errorf("failed to parse tcp_info: %w", err)
+			}
+		}
+		// Attributes are padded to 4 bytes
+		attrs = attrs[min((length+3)&^3, len(attrs)):]
+	}
+
+	return conn, nil
+}
+
+// sockDiagSocket opens a sock_diag socket in the network namespace at path.
+// A socket stays in the namespace it was created in, so only the creating
+// thread switches. That is done on a thread of its own that is thrown away
+// if it can not switch back.
+func sockDiagSocket(path string) (int, error) {
+	type result struct {
+		fd  int
+		err error
+	}
+	done := make(chan result, 1)
+
+	go func() {
+		runtime.LockOSThread()
+
+		fd, restored, err := openInNetns(path)
+		if restored {
+			runtime.UnlockOSThread()
+		}
+		done <- result{fd, err}
+	}()
+
+	r := <-done
+	return r.fd, r.err
+}
+
+// openInNetns switches the calling thread to the network namespace at
+// path, opens a sock_diag socket and switches back. restored is false
+// when the thread is left in another namespace.
+func openInNetns(path string) (fd int, restored bool, err error) {
+	own, err := os.Open(filepath.Join(procfs.Path, "thread-self", "ns", "net"))
+	if err != nil {
+		return -1, true, err
+	}
+	defer own.Close()
+
+	target, err := os.Open(path)
+	if err != nil {
+		return -1, true, err
+	}
+	defer target.Close()
+
+	if err := unix.Setns(int(target.Fd()), unix.CLONE_NEWNET); err != nil {
+		return -1, true, fmt.Errorf("failed to enter network namespace: %w", err)
+	}
+
+	fd, err = unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_SOCK_DIAG)
+	if err != nil {
+		err = fmt.Errorf("failed to open sock_diag socket: %w", err)
+	}
+
+	if serr := unix.Setns(int(own.Fd()), unix.CLONE_NEWNET); serr != nil {
+		if fd >= 0 {
+			unix.Close(fd)
+		}
+		return -1, false, fmt.Errorf("failed to leave network namespace: %w", serr)
+	}
+	return fd, true, err
+}
+
+// seed starts tracking a connection found open at startup. Its current
+// totals count as reported, only traffic from now on is reported. It
+// returns false when the connection is tracked already.
+func (f *dataFlusher) seed(tuple connTuple, state connState) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.states.Update(tuple, state, ebpf.UpdateNoExist); err != nil {
+		if errors.Is(err, ebpf.ErrKeyExist) {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to seed connection state: %w", err)
+	}
+
+	f.reported[flowKey{tuple, types.ProtoTCP}] = connCounters{
+		bytesSent:     state.BytesSent,
+		bytesReceived: state.BytesReceived,
+	}
+	return true, nil
+}
+
+// unseed removes a connection seeded at startTime whose socket is gone. A
+// connection made on the same tuple since replaced the seed and is kept.
+func (f *dataFlusher) unseed(tuple connTuple, startTime uint64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var state connState
+	if err := f.states.Lookup(tuple, &state); err != nil {
+		if errors.Is(err, ebpf.ErrKeyNotExist) {
+			return nil
+		}
+		return fmt.Errorf("failed to read connection state: %w", err)
+	}
+	if state.StartTime != startTime {
+		return nil
+	}
+
+	if err := f.forget(tuple); err != nil {
+		return err
+	}
+	delete(f.reported, flowKey{tuple, types.ProtoTCP})
+	return nil
+}
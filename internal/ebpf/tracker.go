@@ -5,27 +5,123 @@ import (
 	"context"
 	"encoding/binary"
 	"fmt"
+	"io"
 	"log/slog"
+	"net/netip"
+	"slices"
+	"syscall"
 	"time"
-	"unsafe"
 
+	"github.com/cilium/ebpf"
 	"github.com/cilium/ebpf/link"
 	"github.com/cilium/ebpf/ringbuf"
 	"github.com/cilium/ebpf/rlimit"
 	"github.com/pedrospdc/gespann/pkg/types"
 )
 
-//go:generate go run github.com/cilium/ebpf/cmd/bpf2go -cc clang -target bpfel ConnTracker ../../bpf/simple_tracker.c
+//go:generate go run github.com/cilium/ebpf/cmd/bpf2go -cc clang -target bpfel ConnTracker ../../bpf/conn_tracker.c
+//go:generate go run github.com/cilium/ebpf/cmd/bpf2go -cc clang -target bpfel SimpleTracker ../../bpf/simple_tracker.c
+
+const (
+	// ProgramAuto loads the full program set when the kernel supports it and
+	// falls back to the simple one otherwise.
+	ProgramAuto = "auto"
+	// ProgramFull loads bpf/conn_tracker.c.
+	ProgramFull = "full"
+	// ProgramSimple loads bpf/simple_tracker.c, which only reports outbound
+	// TCP connects and closes.
+	ProgramSimple = "simple"
+)
+
+type Config struct {
+	Program string `yaml:"program"`
+	// IdleThreshold is how long a connection must go without traffic to be
+	// reported idle.
+	IdleThreshold time.Duration `yaml:"idle_threshold"`
+	// DataInterval is how often open connections report their traffic in
+	// CONN_DATA events.
+	DataInterval time.Duration `yaml:"data_interval"`
+	// UDPFlowTimeout is how long a UDP flow may go without traffic before
+	// it is reported closed.
+	UDPFlowTimeout time.Duration `yaml:"udp_flow_timeout"`
+	// ResolverUprobes traces getaddrinfo to name connection destinations with
+	// the hostname the process asked for, even when DNS is not visible.
+	ResolverUprobes bool `yaml:"resolver_uprobes"`
+	// ResolverLibraries are the libc builds to trace, the usual glibc and
+	// musl locations when empty. Paths are looked up on the host, so
+	// processes in containers using the libc of their image are not traced.
+	ResolverLibraries []string `yaml:"resolver_libraries"`
+	// ReconcileInterval is how often the open connections are compared with
+	// the connections tracked in the kernel, to correct for lost events.
+	ReconcileInterval time.Duration `yaml:"reconcile_interval"`
+	// Netns limits reporting to these network namespaces, by inode number as
+	// in /proc/<pid>/ns/net. All namespaces are reported when empty.
+	Netns []uint32 `yaml:"netns"`
+}
+
+// trackerConfig mirrors struct tracker_config in conn_tracker.c.
+type trackerConfig struct {
+	IdleThresholdNS uint64
+}
+
+// Address families as reported in conn_tuple.family.
+const (
+	afInet  = 2
+	afInet6 = 10
+)
+
+// taskCommLen mirrors TASK_COMM_LEN in conn_tracker.c.
+const taskCommLen = 16
+
+// connTuple mirrors struct conn_tuple in conn_tracker.c.
+type connTuple struct {
+	SAddr  [16]byte
+	DAddr  [16]byte
+	SPort  uint16
+	DPort  uint16
+	Family uint16
+	_      [2]byte
+	Netns  uint32
+}
+
+// dnsMaxLen mirrors DNS_MAX_LEN in conn_tracker.c.
+const dnsMaxLen = 512
+
+// dnsEvent mirrors struct dns_event in conn_tracker.c.
+type dnsEvent struct {
+	Timestamp     uint64
+	PID           uint32
+	TID           uint32
+	NamespacedPID uint32
+	Tuple         connTuple
+	Comm          [taskCommLen]byte
+	Size          uint32
+	Len           uint16
+	Direction     uint8
+	Protocol      uint8
+	Payload       [dnsMaxLen]byte
+}
+
+// resolveMaxAddrs mirrors RESOLVE_MAX_ADDRS in conn_tracker.c.
+const resolveMaxAddrs = 8
+
+// resolveEvent mirrors struct resolve_event in conn_tracker.c.
+type resolveEvent struct {
+	Timestamp uint64
+	PID       uint32
+	Count     uint32
+	Family    [resolveMaxAddrs]uint16
+	Addrs     [resolveMaxAddrs][16]byte
+	Hostname  [128]byte
+}
 
 type ConnEvent struct {
 	PID           uint32
 	TID           uint32
-	SAddr         uint32
-	DAddr         uint32
-	SPort         uint16
-	DPort         uint16
+	Tuple         connTuple
 	EventType     uint8
 	Protocol      uint8
+	_             [2]byte
 	Timestamp     uint64
 	BytesSent     uint64
 	BytesReceived uint64
@@ -33,20 +129,141 @@ type ConnEvent struct {
 	DurationMS    uint32
 	TCPState      uint8
 	ResetReason   uint8
+	Direction     uint8
+	PrevTCPState  uint8
+	RTTVarMicros  uint32
+	Retransmits   uint32
+	RTOs          uint16
+	LossProbes    uint16
+	SkErr         uint16
+	Idle          uint8
+	_             [1]byte
+	ConnectMicros uint32
+	Comm          [taskCommLen]byte
+	CgroupID      uint64
+	NamespacedPID uint32
+	_             [4]byte
 }
 
 type Tracker struct {
-	objs   ConnTrackerObjects
+	objs   io.Closer
+	probes []probe
+	caps   Capabilities
 	links  []link.Link
 	reader *ringbuf.Reader
 	logger *slog.Logger
+
+	flusher        *dataFlusher
+	dataInterval   time.Duration
+	netns          map[uint32]bool
+	tcpStateCounts *ebpf.Map
+
+	dnsEvents *ebpf.Map
+	dnsReader *ringbuf.Reader
+
+	resolveEvents *ebpf.Map
+	resolveReader *ringbuf.Reader
 }
 
-func NewTracker(logger *slog.Logger) (*Tracker, error) {
+func NewTracker(config Config, logger *slog.Logger) (*Tracker, error) {
 	if err := rlimit.RemoveMemlock(); err != nil {
 		return nil, fmt.Errorf("failed to remove memlock limit: %w", err)
 	}
 
+	t := &Tracker{
+		caps:         Capabilities{Requested: config.Program},
+		logger:       logger,
+		dataInterval: config.DataInterval,
+	}
+	if len(config.Netns) > 0 {
+		t.netns = make(map[uint32]bool, len(config.Netns))
+		for _, inum := range config.Netns {
+			t.netns[inum] = true
+		}
+	}
+
+	var events *ebpf.Map
+	var err error
+	switch config.Program {
+	case ProgramFull:
+		events, err = t.loadFull(config)
+	case ProgramSimple:
+		events, err = t.loadSimple()
+	case ProgramAuto, "":
+		t.caps.Requested = ProgramAuto
+		events, err = t.loadAuto(config)
+	default:
+		return nil, fmt.Errorf("unknown tracker program %q", config.Program)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	reader, err := ringbuf.NewReader(events)
+	if err != nil {
+		t.objs.Close()
+		return nil, fmt.Errorf("failed to create ringbuf reader: %w", err)
+	}
+	t.reader = reader
+
+	if t.dnsEvents != nil {
+		dnsReader, err := ringbuf.NewReader(t.dnsEvents)
+		if err != nil {
+			t.Close()
+			return nil, fmt.Errorf("failed to create DNS ringbuf reader: %w", err)
+		}
+		t.dnsReader = dnsReader
+	}
+
+	if t.resolveEvents != nil {
+		resolveReader, err := ringbuf.NewReader(t.resolveEvents)
+		if err != nil {
+			t.Close()
+			return nil, fmt.Errorf("failed to create resolver ringbuf reader: %w", err)
+		}
+		t.resolveReader = resolveReader
+	}
+
+	return t, nil
+}
+
+func (t *Tracker) loadAuto(config Config) (*ebpf.Map, error) {
+	probes := programProbes(&ConnTrackerObjects{}, config)
+	found, err := probeAvailability(probes)
+	if err != nil {
+		t.logger.Warn("failed to probe kernel support, assuming full support", "error", err)
+	} else {
+		var missing []string
+		for _, p := range probes {
+			if p.required && !found[p.symbol] {
+				missing = append(missing, p.symbol)
+			}
+		}
+		if len(missing) > 0 {
+			t.logger.Warn("kernel lacks required symbols for full tracker, falling back to simple", "missing", missing)
+			return t.loadSimple()
+		}
+	}
+
+	events, err := t.loadFull(config)
+	if err != nil {
+		t.logger.Warn("failed to load full tracker, falling back to simple", "error", err)
+		return t.loadSimple()
+	}
+
+	if found != nil {
+		for i, p := range t.probes {
+			if !found[p.symbol] {
+				t.caps.Probes[i].State = types.ProbeUnavailable
+				t.logger.Warn("optional probe not supported by kernel, skipping", "probe", p.name())
+			}
+		}
+	}
+
+	return events, nil
+}
+
+func (t *Tracker) loadFull(config Config) (*ebpf.Map, error) {
 	spec, err := LoadConnTracker()
 	if err != nil {
 		return nil, fmt.Errorf("failed to load eBPF spec: %w", err)
@@ -57,38 +274,115 @@ func NewTracker(logger *slog.Logger) (*Tracker, error) {
 		return nil, fmt.Errorf("failed to load eBPF objects: %w", err)
 	}
 
-	reader, err := ringbuf.NewReader(objs.Events)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create ringbuf reader: %w", err)
+	settings := trackerConfig{IdleThresholdNS: uint64(config.IdleThreshold)}
+	if err := objs.ConfigMap.Put(uint32(0), settings); err != nil {
+		objs.Close()
+		return nil, fmt.Errorf("failed to write tracker config: %w", err)
 	}
 
-	return &Tracker{
-		objs:   objs,
-		reader: reader,
-		logger: logger,
-	}, nil
+	t.setProgram(ProgramFull, &objs, programProbes(&objs, config))
+	t.flusher = newDataFlusher(objs.ConnStateMap, objs.IdleMap, objs.UdpFlowMap, config.UDPFlowTimeout, config.IdleThreshold)
+	t.tcpStateCounts = objs.TcpStateCounts
+	t.dnsEvents = objs.DnsEvents
+	t.resolveEvents = objs.ResolveEvents
+	return objs.Events, nil
 }
 
-func (t *Tracker) Start(ctx context.Context) error {
-	// Attach kprobe for connect system calls
-	connectLink, err := link.Kprobe("sys_connect", t.objs.TraceConnectEntry, nil)
+func (t *Tracker) loadSimple() (*ebpf.Map, error) {
+	spec, err := LoadSimpleTracker()
 	if err != nil {
-		return fmt.Errorf("failed to attach sys_connect kprobe: %w", err)
+		return nil, fmt.Errorf("failed to load eBPF spec: %w", err)
 	}
-	t.links = append(t.links, connectLink)
 
-	// Attach kprobe for close system calls
-	closeLink, err := link.Kprobe("sys_close", t.objs.TraceCloseEntry, nil)
-	if err != nil {
-		return fmt.Errorf("failed to attach sys_close kprobe: %w", err)
+	var objs SimpleTrackerObjects
+	if err := spec.LoadAndAssign(&objs, nil); err != nil {
+		return nil, fmt.Errorf("failed to load eBPF objects: %w", err)
+	}
+
+	t.setProgram(ProgramSimple, &objs, simpleProbes(&objs))
+	return objs.Events, nil
+}
+
+func (t *Tracker) setProgram(program string, objs io.Closer, probes []probe) {
+	t.objs = objs
+	t.probes = probes
+	t.links = make([]link.Link, len(probes))
+	t.caps.Program = program
+	t.caps.Probes = make([]types.ProbeStatus, len(probes))
+	for i, p := range probes {
+		t.caps.Probes[i] = probeStatus(p, types.ProbeDetached)
 	}
-	t.links = append(t.links, closeLink)
+}
 
-	t.logger.Info("eBPF programs attached successfully")
+// Capabilities returns the selected program set and the state of its probes.
+func (t *Tracker) Capabilities() Capabilities {
+	caps := t.caps
+	caps.Probes = slices.Clone(t.caps.Probes)
+	return caps
+}
+
+// Start attaches every probe of the loaded program set. Optional probes that
+// fail to attach are skipped; a required failure detaches everything.
+func (t *Tracker) Start(ctx context.Context) error {
+	for i, p := range t.probes {
+		status := &t.caps.Probes[i]
+		if status.State == types.ProbeUnavailable {
+			continue
+		}
+
+		l, err := p.attach()
+		if err != nil {
+			status.State = types.ProbeFailed
+			status.Error = err.Error()
+			if p.required {
+				if errs := t.detach(); len(errs) > 0 {
+					t.logger.Error("failed to detach probes", "errors", errs)
+				}
+				return fmt.Errorf("failed to attach required probe %s: %w", p.name(), err)
+			}
+			t.logger.Warn("optional probe failed to attach, continuing without it",
+				"probe", p.name(),
+				"error", err,
+			)
+			continue
+		}
+
+		t.links[i] = l
+		status.State = types.ProbeAttached
+		status.Error = ""
+	}
+
+	t.logger.Info("eBPF programs attached successfully",
+		"program", t.caps.Program,
+		"active_probes", t.caps.ActiveProbes(),
+		"missing_probes", t.caps.MissingProbes(),
+	)
 	return nil
 }
 
+func (t *Tracker) detach() []error {
+	var errs []error
+	for i, l := range t.links {
+		if l == nil {
+			continue
+		}
+		if err := l.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("failed to detach %s: %w", t.probes[i].name(), err))
+		}
+		t.links[i] = nil
+		t.caps.Probes[i].State = types.ProbeDetached
+	}
+	return errs
+}
+
 func (t *Tracker) ReadEvents(ctx context.Context, eventCh chan<- types.ConnEvent) error {
+	if t.flusher != nil {
+		go t.reportExisting(ctx, eventCh)
+	}
+	if t.flusher != nil && t.dataInterval > 0 {
+		go t.reportData(ctx, eventCh)
+	}
+
 	for {
 		select {
 		case <-ctx.Done():
@@ -103,7 +397,7 @@ func (t *Tracker) ReadEvents(ctx context.Context, eventCh chan<- types.ConnEvent
 				continue
 			}
 
-			if len(record.RawSample) < int(unsafe.Sizeof(ConnEvent{})) {
+			if len(record.RawSample) < binary.Size(ConnEvent{}) {
 				t.logger.Warn("received truncated event")
 				continue
 			}
@@ -114,22 +408,47 @@ func (t *Tracker) ReadEvents(ctx context.Context, eventCh chan<- types.ConnEvent
 				continue
 			}
 
+			// Process exits belong to no namespace
+			if types.EventType(rawEvent.EventType) != types.ProcessExit && !t.traced(rawEvent.Tuple.Netns) {
+				continue
+			}
+
 			event := types.ConnEvent{
 				PID:           rawEvent.PID,
+				NamespacedPID: rawEvent.NamespacedPID,
 				TID:           rawEvent.TID,
-				SAddr:         rawEvent.SAddr,
-				DAddr:         rawEvent.DAddr,
-				SPort:         rawEvent.SPort,
-				DPort:         rawEvent.DPort,
+				Netns:         rawEvent.Tuple.Netns,
+				SAddr:         parseAddr(rawEvent.Tuple.Family, rawEvent.Tuple.SAddr),
+				DAddr:         parseAddr(rawEvent.Tuple.Family, rawEvent.Tuple.DAddr),
+				SPort:         rawEvent.Tuple.SPort,
+				DPort:         rawEvent.Tuple.DPort,
 				Type:          types.EventType(rawEvent.EventType),
 				Protocol:      types.ProtocolType(rawEvent.Protocol),
 				Timestamp:     time.Unix(0, int64(rawEvent.Timestamp)),
 				BytesSent:     rawEvent.BytesSent,
 				BytesReceived: rawEvent.BytesReceived,
 				RTTMicros:     rawEvent.RTTMicros,
+				RTTVarMicros:  rawEvent.RTTVarMicros,
+				Retransmits:   rawEvent.Retransmits,
+				RTOs:          rawEvent.RTOs,
+				LossProbes:    rawEvent.LossProbes,
+				Idle:          rawEvent.Idle != 0,
 				DurationMS:    rawEvent.DurationMS,
-				TCPState:      rawEvent.TCPState,
+				ConnectMicros: rawEvent.ConnectMicros,
+				TCPState:      types.TCPState(rawEvent.TCPState),
+				PrevTCPState:  types.TCPState(rawEvent.PrevTCPState),
 				ResetReason:   types.ResetReason(rawEvent.ResetReason),
+				Direction:     types.Direction(rawEvent.Direction),
+				Process:       types.ProcessInfo{Comm: cString(rawEvent.Comm[:])},
+				Cgroup:        types.CgroupInfo{ID: rawEvent.CgroupID},
+			}
+			if event.Type == types.ConnFailed {
+				event.FailureReason = failureReason(rawEvent.SkErr)
+			}
+
+			// Teardown events carry totals, drop what CONN_DATA already reported
+			if t.flusher != nil && isTeardown(event.Type) {
+				t.flusher.settle(rawEvent.Tuple, &event)
 			}
 
 			select {
@@ -143,14 +462,169 @@ func (t *Tracker) ReadEvents(ctx context.Context, eventCh chan<- types.ConnEvent
 	}
 }
 
-func (t *Tracker) Close() error {
-	var errs []error
+// ReadDNS forwards the DNS messages captured by the full program set. It
+// returns right away for the simple one, which does not capture any.
+func (t *Tracker) ReadDNS(ctx context.Context, packetCh chan<- types.DNSPacket) error {
+	if t.dnsReader == nil {
+		return nil
+	}
 
-	for _, l := range t.links {
-		if err := l.Close(); err != nil {
-			errs = append(errs, err)
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+			record, err := t.dnsReader.Read()
+			if err != nil {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				t.logger.Error("failed to read from DNS ringbuf", "error", err)
+				continue
+			}
+
+			if len(record.RawSample) < binary.Size(dnsEvent{}) {
+				t.logger.Warn("received truncated DNS event")
+				continue
+			}
+
+			var raw dnsEvent
+			if err := binary.Read(bytes.NewReader(record.RawSample), binary.LittleEndian, &raw); err != nil {
+				t.logger.Error("failed to parse DNS event", "error", err)
+				continue
+			}
+
+			if !t.traced(raw.Tuple.Netns) {
+				continue
+			}
+
+			length := min(int(raw.Len), len(raw.Payload))
+			packet := types.DNSPacket{
+				PID:           raw.PID,
+				NamespacedPID: raw.NamespacedPID,
+				Comm:          cString(raw.Comm[:]),
+				Netns:         raw.Tuple.Netns,
+				Timestamp:     time.Unix(0, int64(raw.Timestamp)),
+				Protocol:      types.ProtocolType(raw.Protocol),
+				Local:         netip.AddrPortFrom(parseAddr(raw.Tuple.Family, raw.Tuple.SAddr), raw.Tuple.SPort),
+				Remote:        netip.AddrPortFrom(parseAddr(raw.Tuple.Family, raw.Tuple.DAddr), raw.Tuple.DPort),
+				Outbound:      raw.Direction == uint8(types.DirectionOutbound),
+				Size:          int(raw.Size),
+				Payload:       slices.Clone(raw.Payload[:length]),
+			}
+
+			select {
+			case packetCh <- packet:
+			case <-ctx.Done():
+				return ctx.Err()
+			default:
+				t.logger.Warn("DNS packet channel full, dropping packet")
+			}
 		}
 	}
+}
+
+// ReadResolutions forwards the getaddrinfo results seen by the resolver
+// uprobes. It returns right away for the simple program set.
+func (t *Tracker) ReadResolutions(ctx context.Context, resolutionCh chan<- types.Resolution) error {
+	if t.resolveReader == nil {
+		return nil
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+			record, err := t.resolveReader.Read()
+			if err != nil {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				t.logger.Error("failed to read from resolver ringbuf", "error", err)
+				continue
+			}
+
+			if len(record.RawSample) < binary.Size(resolveEvent{}) {
+				t.logger.Warn("received truncated resolver event")
+				continue
+			}
+
+			var raw resolveEvent
+			if err := binary.Read(bytes.NewReader(record.RawSample), binary.LittleEndian, &raw); err != nil {
+				t.logger.Error("failed to parse resolver event", "error", err)
+				continue
+			}
+
+			resolution := types.Resolution{
+				PID:       raw.PID,
+				Timestamp: time.Unix(0, int64(raw.Timestamp)),
+				Hostname:  cString(raw.Hostname[:]),
+			}
+			for i := 0; i < int(min(raw.Count, resolveMaxAddrs)); i++ {
+				addr := parseAddr(raw.Family[i], raw.Addrs[i])
+				// glibc returns every address once per socket type
+				if addr.IsValid() && !slices.Contains(resolution.Addrs, addr) {
+					resolution.Addrs = append(resolution.Addrs, addr)
+				}
+			}
+
+			select {
+			case resolutionCh <- resolution:
+			case <-ctx.Done():
+				return ctx.Err()
+			default:
+				t.logger.Warn("resolution channel full, dropping resolution")
+			}
+		}
+	}
+}
+
+// parseAddr converts a conn_tuple address into a netip.Addr. IPv4 addresses
+// are stored in the first 4 bytes.
+func parseAddr(family uint16, raw [16]byte) netip.Addr {
+	switch family {
+	case afInet:
+		return netip.AddrFrom4([4]byte(raw[:4]))
+	case afInet6:
+		return netip.AddrFrom16(raw)
+	default:
+		return netip.Addr{}
+	}
+}
+
+// traced reports whether events from a network namespace are reported.
+func (t *Tracker) traced(netns uint32) bool {
+	return t.netns == nil || t.netns[netns]
+}
+
+// cString converts a NUL terminated kernel string.
+func cString(b []byte) string {
+	s, _, _ := bytes.Cut(b, []byte{0})
+	return string(s)
+}
+
+// failureReason classifies the sk_err of a failed connect. No error means
+// the application gave up before the kernel did.
+func failureReason(errno uint16) types.FailureReason {
+	switch syscall.Errno(errno) {
+	case 0:
+		return types.FailureAborted
+	case syscall.ECONNREFUSED:
+		return types.FailureRefused
+	case syscall.ETIMEDOUT:
+		return types.FailureTimeout
+	case syscall.EHOSTUNREACH:
+		return types.FailureHostUnreachable
+	case syscall.ENETUNREACH:
+		return types.FailureNetUnreachable
+	default:
+		return types.FailureOther
+	}
+}
+
+func (t *Tracker) Close() error {
+	errs := t.detach()
 
 	if t.reader != nil {
 		if err := t.reader.Close(); err != nil {
@@ -158,8 +632,22 @@ func (t *Tracker) Close() error {
 		}
 	}
 
-	if err := t.objs.Close(); err != nil {
-		errs = append(errs, err)
+	if t.dnsReader != nil {
+		if err := t.dnsReader.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if t.resolveReader != nil {
+		if err := t.resolveReader.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if t.objs != nil {
+		if err := t.objs.Close(); err != nil {
+			errs = append(errs, err)
+		}
 	}
 
 	if len(errs) > 0 {
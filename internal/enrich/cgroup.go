@@ -0,0 +1,163 @@
+package enrich
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pedrospdc/gespann/internal/procfs"
+	"github.com/pedrospdc/gespann/pkg/types"
+)
+
+// Unknown cgroup IDs trigger a rescan for cgroups created since the last
+// one, at most this often.
+const minCgroupRescan = 10 * time.Second
+
+// containerCgroup matches the cgroup of a container as created by the
+// systemd and cgroupfs drivers: "docker-<id>.scope", "cri-containerd-<id>.scope",
+// "crio-<id>.scope", "libpod-<id>.scope" or a bare "<id>".
+var containerCgroup = regexp.MustCompile(`^(?:(docker|cri-containerd|crio|libpod)-)?([0-9a-f]{64})(?:\.scope)?$`)
+
+// containerRuntimes maps cgroup name prefixes, and the parent directory
+// used by the cgroupfs driver, to runtime names.
+var containerRuntimes = map[string]string{
+	"docker":         "docker",
+	"cri-containerd": "containerd",
+	"crio":           "cri-o",
+	"libpod":         "podman",
+}
+
+// Cgroups resolves the cgroup IDs captured in the kernel to cgroup paths and
+// the container or systemd unit they belong to. A cgroup v2 ID is the inode
+// number of its directory in cgroupfs.
+type Cgroups struct {
+	logger *slog.Logger
+
+	mu      sync.Mutex
+	cgroups map[uint64]types.CgroupInfo
+	scanned time.Time
+}
+
+func NewCgroups(logger *slog.Logger) *Cgroups {
+	return &Cgroups{
+		logger:  logger,
+		cgroups: make(map[uint64]types.CgroupInfo),
+	}
+}
+
+// Annotate fills in the cgroup path, container and systemd unit.
+func (c *Cgroups) Annotate(event *types.ConnEvent) {
+	if event.Cgroup.ID == 0 {
+		return
+	}
+	if info, ok := c.lookup(event.Cgroup.ID); ok {
+		event.Cgroup = info
+	}
+}
+
+func (c *Cgroups) lookup(id uint64) (types.CgroupInfo, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if info, ok := c.cgroups[id]; ok {
+		return info, true
+	}
+	if time.Since(c.scanned) < minCgroupRescan {
+		return types.CgroupInfo{}, false
+	}
+	c.scanned = time.Now()
+
+	// Rebuilding the table also drops cgroups that were removed
+	cgroups, err := scanCgroups()
+	if err != nil {
+		c.logger.Warn("failed to scan cgroups", "error", err)
+		return types.CgroupInfo{}, false
+	}
+	c.cgroups = cgroups
+
+	info, ok := c.cgroups[id]
+	return info, ok
+}
+
+// scanCgroups walks the cgroup v2 hierarchy and describes every cgroup in it.
+func scanCgroups() (map[uint64]types.CgroupInfo, error) {
+	root, err := procfs.CgroupRoot()
+	if err != nil {
+		return nil, err
+	}
+
+	cgroups := make(map[uint64]types.CgroupInfo)
+	err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// Cgroups come and go while walking
+			if path != root && errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		stat, ok := fi.Sys().(*syscall.Stat_t)
+		if !ok {
+			return nil
+		}
+
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			rel = ""
+		}
+		info := parseCgroupPath("/" + rel)
+		info.ID = stat.Ino
+		cgroups[info.ID] = info
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to walk %s: %w", root, err)
+	}
+
+	return cgroups, nil
+}
+
+// parseCgroupPath derives the container and systemd unit from a cgroup path.
+// The outermost container wins, processes may run in sub-cgroups of their
+// container. The unit is the innermost service or scope that is not a
+// container.
+func parseCgroupPath(path string) types.CgroupInfo {
+	info := types.CgroupInfo{Path: path}
+
+	elems := strings.Split(strings.Trim(path, "/"), "/")
+	for i := len(elems) - 1; i >= 0; i-- {
+		elem := elems[i]
+
+		if m := containerCgroup.FindStringSubmatch(elem); m != nil {
+			info.ContainerID = m[2]
+			info.Runtime = containerRuntimes[m[1]]
+			if m[1] == "" && i > 0 {
+				info.Runtime = containerRuntimes[elems[i-1]]
+			}
+			continue
+		}
+
+		if info.SystemdUnit == "" && info.ContainerID == "" &&
+			(strings.HasSuffix(elem, ".service") || strings.HasSuffix(elem, ".scope")) {
+			info.SystemdUnit = elem
+		}
+	}
+
+	return info
+}
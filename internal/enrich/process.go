@@ -0,0 +1,129 @@
+package enrich
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pedrospdc/gespann/internal/procfs"
+	"github.com/pedrospdc/gespann/pkg/types"
+)
+
+const (
+	// Entries are dropped on process exit. The age limit covers exits that
+	// were not seen, so a reused PID is not reported as the old process.
+	maxProcessAge     = 10 * time.Minute
+	maxProcessEntries = 65536
+	maxCmdlineLen     = 4096
+)
+
+type processEntry struct {
+	info types.ProcessInfo
+	// nsPID is the PID in the process's own PID namespace
+	nsPID  uint32
+	loaded time.Time
+}
+
+// Processes caches what /proc says about the processes owning connections,
+// keyed by PID.
+type Processes struct {
+	mu      sync.Mutex
+	entries map[uint32]processEntry
+}
+
+func NewProcesses() *Processes {
+	return &Processes{
+		entries: make(map[uint32]processEntry),
+	}
+}
+
+// Annotate fills in the executable, command line and UID of the process
+// owning the connection. The comm captured in the kernel is kept, it names
+// the thread that made the call. The namespaced PID is taken from /proc
+// when the kernel did not provide it.
+func (p *Processes) Annotate(event *types.ConnEvent) {
+	if event.PID == 0 {
+		return
+	}
+
+	entry := p.lookup(event.PID)
+	info := entry.info
+	if event.Process.Comm != "" {
+		info.Comm = event.Process.Comm
+	}
+	event.Process = info
+	if event.NamespacedPID == 0 {
+		event.NamespacedPID = entry.nsPID
+	}
+}
+
+// Forget drops the cached metadata of an exited process.
+func (p *Processes) Forget(pid uint32) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	delete(p.entries, pid)
+}
+
+func (p *Processes) lookup(pid uint32) processEntry {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	if entry, ok := p.entries[pid]; ok && now.Sub(entry.loaded) < maxProcessAge {
+		return entry
+	}
+
+	// A process that already exited is cached empty, so it is not looked
+	// up again for every event it left behind.
+	entry := readProcess(pid)
+	entry.loaded = now
+	if _, ok := p.entries[pid]; !ok && len(p.entries) >= maxProcessEntries {
+		p.prune(now)
+		if len(p.entries) >= maxProcessEntries {
+			return entry
+		}
+	}
+	p.entries[pid] = entry
+	return entry
+}
+
+func (p *Processes) prune(now time.Time) {
+	for pid, entry := range p.entries {
+		if now.Sub(entry.loaded) >= maxProcessAge {
+			delete(p.entries, pid)
+		}
+	}
+}
+
+// readProcess reads what /proc knows about pid. Fields that cannot be read
+// are left empty.
+func readProcess(pid uint32) processEntry {
+	var info types.ProcessInfo
+	dir := filepath.Join(procfs.Path, strconv.FormatUint(uint64(pid), 10))
+
+	if exe, err := os.Readlink(filepath.Join(dir, "exe")); err == nil {
+		info.Exe = strings.TrimSuffix(exe, " (deleted)")
+	}
+
+	if cmdline, err := os.ReadFile(filepath.Join(dir, "cmdline")); err == nil {
+		if len(cmdline) > maxCmdlineLen {
+			cmdline = cmdline[:maxCmdlineLen]
+		}
+		cmdline = bytes.TrimRight(cmdline, "\x00")
+		info.Cmdline = string(bytes.ReplaceAll(cmdline, []byte{0}, []byte{' '}))
+	}
+
+	if comm, err := os.ReadFile(filepath.Join(dir, "comm")); err == nil {
+		info.Comm = strings.TrimSpace(string(comm))
+	}
+
+	uid, nsPID := procfs.ReadStatus(filepath.Join(dir, "status"))
+	info.UID = uid
+
+	return processEntry{info: info, nsPID: nsPID}
+}
@@ -0,0 +1,59 @@
+package enrich
+
+import (
+	"context"
+
+	"github.com/pedrospdc/gespann/pkg/types"
+)
+
+// Annotator adds metadata to a connection event.
+type Annotator interface {
+	Annotate(event *types.ConnEvent)
+}
+
+// Stage sits between the tracker and the collector and annotates every
+// event with process metadata and whatever the other annotators know.
+type Stage struct {
+	processes  *Processes
+	annotators []Annotator
+}
+
+func NewStage(processes *Processes, annotators ...Annotator) *Stage {
+	return &Stage{
+		processes:  processes,
+		annotators: annotators,
+	}
+}
+
+// Run annotates events from in and passes them on to out until ctx is done
+// or in is closed. Process exits only invalidate cached metadata and are
+// not passed on. out is closed when Run returns.
+func (s *Stage) Run(ctx context.Context, in <-chan types.ConnEvent, out chan<- types.ConnEvent) {
+	defer close(out)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event, ok := <-in:
+			if !ok {
+				return
+			}
+			if event.Type == types.ProcessExit {
+				s.processes.Forget(event.PID)
+				continue
+			}
+
+			s.processes.Annotate(&event)
+			for _, a := range s.annotators {
+				a.Annotate(&event)
+			}
+
+			select {
+			case out <- event:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,389 @@
+package kubernetes
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/netip"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pedrospdc/gespann/pkg/types"
+)
+
+const (
+	podsPath     = "/api/v1/pods"
+	servicesPath = "/api/v1/services"
+
+	minRetryDelay = time.Second
+	maxRetryDelay = 30 * time.Second
+)
+
+// podCgroup matches the pod UID in a pod's cgroup, "pod<uid>" with the
+// cgroupfs driver and "kubepods-<qos>-pod<uid with _>.slice" with systemd.
+var podCgroup = regexp.MustCompile(`pod([0-9a-f]{8}[-_][0-9a-f]{4}[-_][0-9a-f]{4}[-_][0-9a-f]{4}[-_][0-9a-f]{12})`)
+
+// store keeps the objects of one resource up to date from list and watch.
+type store interface {
+	replace(items []json.RawMessage) error
+	apply(eventType string, object json.RawMessage) error
+}
+
+// Cache mirrors the cluster's pods and Services from the API server, list
+// then watch, and labels connections with the pods and Services on both
+// ends. Containers are matched by ID or by the pod UID in their cgroup,
+// remote addresses by pod IP or Service cluster IP.
+type Cache struct {
+	client   apiClient
+	logger   *slog.Logger
+	pods     *podStore
+	services *serviceStore
+}
+
+func NewCache(config Config, logger *slog.Logger) (*Cache, error) {
+	client, err := newClient(config)
+	if err != nil {
+		return nil, err
+	}
+	return newCache(client, logger), nil
+}
+
+func newCache(client apiClient, logger *slog.Logger) *Cache {
+	return &Cache{
+		client:   client,
+		logger:   logger,
+		pods:     newPodStore(),
+		services: newServiceStore(),
+	}
+}
+
+// Run keeps the cache in sync until ctx is done.
+func (c *Cache) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		c.sync(ctx, podsPath, c.pods)
+	}()
+	go func() {
+		defer wg.Done()
+		c.sync(ctx, servicesPath, c.services)
+	}()
+	wg.Wait()
+}
+
+// sync lists a resource and watches it from there, listing again when the
+// watch can not be resumed.
+func (c *Cache) sync(ctx context.Context, path string, s store) {
+	delay := minRetryDelay
+	for {
+		items, resourceVersion, err := c.client.list(ctx, path)
+		if err == nil {
+			err = s.replace(items)
+		}
+		if err == nil {
+			delay = minRetryDelay
+			err = c.watch(ctx, path, resourceVersion, s)
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		if errors.Is(err, errGone) {
+			c.logger.Debug("watch expired, listing again", "path", path)
+			continue
+		}
+
+		c.logger.Warn("failed to sync Kubernetes resource", "path", path, "error", err, "retry_in", delay)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		delay = min(delay*2, maxRetryDelay)
+	}
+}
+
+// watch applies changes from resourceVersion on, resuming the watch each
+// time the server ends it, until it fails.
+func (c *Cache) watch(ctx context.Context, path, resourceVersion string, s store) error {
+	for {
+		err := c.client.watch(ctx, path, resourceVersion, func(event watchEvent) error {
+			var object struct {
+				Metadata objectMeta `json:"metadata"`
+			}
+			if err := json.Unmarshal(event.Object, &object); err != nil {
+				return err
+			}
+			resourceVersion = object.Metadata.ResourceVersion
+			if event.Type == "BOOKMARK" {
+				return nil
+			}
+			return s.apply(event.Type, event.Object)
+		})
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Annotate sets the pod of the process and the pod or Service of the peer.
+// The local address identifies the pod when the cgroup does not, e.g. on
+// cgroup v1 hosts.
+func (c *Cache) Annotate(event *types.ConnEvent) {
+	event.Pod = c.pods.byCgroup(event.Cgroup)
+	if event.Pod == nil {
+		event.Pod = c.pods.byAddr(event.SAddr)
+	}
+	event.PeerPod = c.pods.byAddr(event.DAddr)
+	event.PeerService = c.services.byAddr(event.DAddr)
+}
+
+// podEntry is a pod and the keys it is indexed by.
+type podEntry struct {
+	info       *types.PodInfo
+	containers []string
+	addrs      []netip.Addr
+}
+
+type podStore struct {
+	mu         sync.RWMutex
+	pods       map[string]*podEntry
+	containers map[string]*podEntry
+	addrs      map[netip.Addr]*podEntry
+}
+
+func newPodStore() *podStore {
+	return &podStore{
+		pods:       make(map[string]*podEntry),
+		containers: make(map[string]*podEntry),
+		addrs:      make(map[netip.Addr]*podEntry),
+	}
+}
+
+func (s *podStore) replace(items []json.RawMessage) error {
+	entries := make(map[string]*podEntry, len(items))
+	for _, item := range items {
+		var p pod
+		if err := json.Unmarshal(item, &p); err != nil {
+			return err
+		}
+		entries[p.Metadata.UID] = newPodEntry(p)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.pods = make(map[string]*podEntry, len(entries))
+	s.containers = make(map[string]*podEntry)
+	s.addrs = make(map[netip.Addr]*podEntry, len(entries))
+	for uid, entry := range entries {
+		s.add(uid, entry)
+	}
+	return nil
+}
+
+func (s *podStore) apply(eventType string, object json.RawMessage) error {
+	var p pod
+	if err := json.Unmarshal(object, &p); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.remove(p.Metadata.UID)
+	if eventType != "DELETED" {
+		s.add(p.Metadata.UID, newPodEntry(p))
+	}
+	return nil
+}
+
+func (s *podStore) add(uid string, entry *podEntry) {
+	s.pods[uid] = entry
+	for _, id := range entry.containers {
+		s.containers[id] = entry
+	}
+	for _, addr := range entry.addrs {
+		s.addrs[addr] = entry
+	}
+}
+
+// remove drops a pod. Keys already taken over by another pod, like the IP
+// of a terminated pod, are left alone.
+func (s *podStore) remove(uid string) {
+	entry, ok := s.pods[uid]
+	if !ok {
+		return
+	}
+	delete(s.pods, uid)
+	for _, id := range entry.containers {
+		if s.containers[id] == entry {
+			delete(s.containers, id)
+		}
+	}
+	for _, addr := range entry.addrs {
+		if s.addrs[addr] == entry {
+			delete(s.addrs, addr)
+		}
+	}
+}
+
+func (s *podStore) byCgroup(cgroup types.CgroupInfo) *types.PodInfo {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if entry, ok := s.containers[cgroup.ContainerID]; ok && cgroup.ContainerID != "" {
+		return entry.info
+	}
+	if m := podCgroup.FindStringSubmatch(cgroup.Path); m != nil {
+		if entry, ok := s.pods[strings.ReplaceAll(m[1], "_", "-")]; ok {
+			return entry.info
+		}
+	}
+	return nil
+}
+
+func (s *podStore) byAddr(addr netip.Addr) *types.PodInfo {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if entry, ok := s.addrs[addr.Unmap()]; ok {
+		return entry.info
+	}
+	return nil
+}
+
+func newPodEntry(p pod) *podEntry {
+	kind, name := workload(p.Metadata)
+	entry := &podEntry{
+		info: &types.PodInfo{
+			Name:         p.Metadata.Name,
+			Namespace:    p.Metadata.Namespace,
+			Labels:       p.Metadata.Labels,
+			WorkloadKind: kind,
+			Workload:     name,
+		},
+	}
+
+	for _, statuses := range [][]containerStatus{p.Status.InitContainerStatuses, p.Status.ContainerStatuses} {
+		for _, status := range statuses {
+			if _, id, ok := strings.Cut(status.ContainerID, "://"); ok {
+				entry.containers = append(entry.containers, id)
+			}
+		}
+	}
+
+	// Host network pods share the node's address, and the addresses of
+	// finished pods are handed out again
+	if p.Spec.HostNetwork || p.Status.Phase == "Succeeded" || p.Status.Phase == "Failed" {
+		return entry
+	}
+	ips := []string{p.Status.PodIP}
+	for _, ip := range p.Status.PodIPs {
+		ips = append(ips, ip.IP)
+	}
+	for _, ip := range ips {
+		if addr, err := netip.ParseAddr(ip); err == nil {
+			entry.addrs = append(entry.addrs, addr)
+		}
+	}
+
+	return entry
+}
+
+// workload returns the controller owning a pod. ReplicaSets created by a
+// Deployment are reported as the Deployment, their name is the Deployment
+// name followed by the pod template hash.
+func workload(meta objectMeta) (string, string) {
+	for _, ref := range meta.OwnerReferences {
+		if !ref.Controller {
+			continue
+		}
+		if ref.Kind == "ReplicaSet" {
+			if hash := meta.Labels["pod-template-hash"]; hash != "" {
+				if name, ok := strings.CutSuffix(ref.Name, "-"+hash); ok {
+					return "Deployment", name
+				}
+			}
+		}
+		return ref.Kind, ref.Name
+	}
+	return "Pod", meta.Name
+}
+
+type serviceStore struct {
+	mu       sync.RWMutex
+	services map[string][]netip.Addr
+	addrs    map[netip.Addr]*types.ServiceInfo
+}
+
+func newServiceStore() *serviceStore {
+	return &serviceStore{
+		services: make(map[string][]netip.Addr),
+		addrs:    make(map[netip.Addr]*types.ServiceInfo),
+	}
+}
+
+func (s *serviceStore) replace(items []json.RawMessage) error {
+	services := make([]service, 0, len(items))
+	for _, item := range items {
+		var svc service
+		if err := json.Unmarshal(item, &svc); err != nil {
+			return err
+		}
+		services = append(services, svc)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.services = make(map[string][]netip.Addr, len(services))
+	s.addrs = make(map[netip.Addr]*types.ServiceInfo, len(services))
+	for _, svc := range services {
+		s.add(svc)
+	}
+	return nil
+}
+
+func (s *serviceStore) apply(eventType string, object json.RawMessage) error {
+	var svc service
+	if err := json.Unmarshal(object, &svc); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, addr := range s.services[svc.Metadata.UID] {
+		delete(s.addrs, addr)
+	}
+	delete(s.services, svc.Metadata.UID)
+	if eventType != "DELETED" {
+		s.add(svc)
+	}
+	return nil
+}
+
+// add indexes a Service by its cluster IPs, headless Services have none.
+func (s *serviceStore) add(svc service) {
+	info := &types.ServiceInfo{Name: svc.Metadata.Name, Namespace: svc.Metadata.Namespace}
+
+	var addrs []netip.Addr
+	for _, ip := range svc.Spec.ClusterIPs {
+		if addr, err := netip.ParseAddr(ip); err == nil {
+			addrs = append(addrs, addr)
+			s.addrs[addr] = info
+		}
+	}
+	s.services[svc.Metadata.UID] = addrs
+}
+
+func (s *serviceStore) byAddr(addr netip.Addr) *types.ServiceInfo {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.addrs[addr.Unmap()]
+}
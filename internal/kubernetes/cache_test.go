@@ -0,0 +1,350 @@
+package kubernetes
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/netip"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pedrospdc/gespann/pkg/types"
+)
+
+// fakeList is the reply to one list call.
+type fakeList struct {
+	items           []json.RawMessage
+	resourceVersion string
+}
+
+// fakeWatch is one watch session, its events then how it ends.
+type fakeWatch struct {
+	events []watchEvent
+	err    error
+}
+
+// fakeClient replays scripted list and watch replies for a single path.
+// Once the script is used up, watch closes drained and blocks until the
+// context is done.
+type fakeClient struct {
+	mu      sync.Mutex
+	lists   []fakeList
+	watches []fakeWatch
+	// watchedFrom records the resource version of every watch call
+	watchedFrom []string
+	drained     chan struct{}
+}
+
+func newFakeClient(lists []fakeList, watches []fakeWatch) *fakeClient {
+	return &fakeClient{lists: lists, watches: watches, drained: make(chan struct{})}
+}
+
+func (f *fakeClient) list(ctx context.Context, path string) ([]json.RawMessage, string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if len(f.lists) == 0 {
+		return nil, "", io.ErrUnexpectedEOF
+	}
+	l := f.lists[0]
+	f.lists = f.lists[1:]
+	return l.items, l.resourceVersion, nil
+}
+
+func (f *fakeClient) watch(ctx context.Context, path, resourceVersion string, handle func(watchEvent) error) error {
+	f.mu.Lock()
+	f.watchedFrom = append(f.watchedFrom, resourceVersion)
+	if len(f.watches) == 0 {
+		f.mu.Unlock()
+		close(f.drained)
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	w := f.watches[0]
+	f.watches = f.watches[1:]
+	f.mu.Unlock()
+
+	for _, event := range w.events {
+		if err := handle(event); err != nil {
+			return err
+		}
+	}
+	return w.err
+}
+
+// runSync syncs s from client until the script is used up.
+func runSync(t *testing.T, client *fakeClient, path string, s store) {
+	t.Helper()
+
+	c := newCache(client, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.sync(ctx, path, s)
+	}()
+
+	select {
+	case <-client.drained:
+	case <-time.After(5 * time.Second):
+		t.Fatal("sync did not use up the script")
+	}
+	cancel()
+	<-done
+}
+
+func object(t *testing.T, v any) json.RawMessage {
+	t.Helper()
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func testPod(t *testing.T, uid, name, resourceVersion, ip, containerID string) json.RawMessage {
+	return object(t, map[string]any{
+		"metadata": map[string]any{
+			"name":            name,
+			"namespace":       "default",
+			"uid":             uid,
+			"resourceVersion": resourceVersion,
+		},
+		"status": map[string]any{
+			"phase":             "Running",
+			"podIP":             ip,
+			"containerStatuses": []map[string]any{{"containerID": "containerd://" + containerID}},
+		},
+	})
+}
+
+func podName(info *types.PodInfo) string {
+	if info == nil {
+		return ""
+	}
+	return info.Name
+}
+
+func TestCacheSyncPods(t *testing.T) {
+	client := newFakeClient(
+		[]fakeList{{
+			items:           []json.RawMessage{testPod(t, "uid-a", "a", "1", "10.0.0.1", "aaa")},
+			resourceVersion: "1",
+		}},
+		[]fakeWatch{{
+			events: []watchEvent{
+				{Type: "ADDED", Object: testPod(t, "uid-b", "b", "2", "10.0.0.2", "bbb")},
+				{Type: "MODIFIED", Object: testPod(t, "uid-a", "a", "3", "10.0.0.3", "aaa")},
+				{Type: "BOOKMARK", Object: object(t, map[string]any{"metadata": map[string]any{"resourceVersion": "4"}})},
+				{Type: "DELETED", Object: testPod(t, "uid-b", "b", "5", "10.0.0.2", "bbb")},
+				{Type: "BOOKMARK", Object: object(t, map[string]any{"metadata": map[string]any{"resourceVersion": "6"}})},
+			},
+		}},
+	)
+	pods := newPodStore()
+	runSync(t, client, podsPath, pods)
+
+	// The watch is resumed from the last version seen, bookmarks included
+	if want := []string{"1", "6"}; !slices.Equal(client.watchedFrom, want) {
+		t.Errorf("watched from %v, want %v", client.watchedFrom, want)
+	}
+
+	tests := []struct {
+		addr string
+		want string
+	}{
+		{"10.0.0.1", ""},
+		{"10.0.0.2", ""},
+		{"10.0.0.3", "a"},
+		{"::ffff:10.0.0.3", "a"},
+	}
+	for _, tt := range tests {
+		if got := podName(pods.byAddr(netip.MustParseAddr(tt.addr))); got != tt.want {
+			t.Errorf("byAddr(%s) = %q, want %q", tt.addr, got, tt.want)
+		}
+	}
+	if got := podName(pods.byCgroup(types.CgroupInfo{ContainerID: "aaa"})); got != "a" {
+		t.Errorf("container aaa belongs to %q, want a", got)
+	}
+	if got := podName(pods.byCgroup(types.CgroupInfo{ContainerID: "bbb"})); got != "" {
+		t.Errorf("container bbb of a deleted pod belongs to %q", got)
+	}
+}
+
+func TestCacheRelistAfterGone(t *testing.T) {
+	client := newFakeClient(
+		[]fakeList{
+			{items: []json.RawMessage{testPod(t, "uid-a", "a", "1", "10.0.0.1", "aaa")}, resourceVersion: "1"},
+			{items: []json.RawMessage{testPod(t, "uid-b", "b", "7", "10.0.0.2", "bbb")}, resourceVersion: "7"},
+		},
+		[]fakeWatch{{err: errGone}},
+	)
+	pods := newPodStore()
+	runSync(t, client, podsPath, pods)
+
+	if want := []string{"1", "7"}; !slices.Equal(client.watchedFrom, want) {
+		t.Errorf("watched from %v, want %v", client.watchedFrom, want)
+	}
+	// The second list replaces the first
+	if got := podName(pods.byAddr(netip.MustParseAddr("10.0.0.1"))); got != "" {
+		t.Errorf("10.0.0.1 belongs to %q after relisting", got)
+	}
+	if got := podName(pods.byAddr(netip.MustParseAddr("10.0.0.2"))); got != "b" {
+		t.Errorf("10.0.0.2 belongs to %q, want b", got)
+	}
+}
+
+func TestCacheSyncServices(t *testing.T) {
+	svc := func(uid, name string, ips ...string) json.RawMessage {
+		return object(t, map[string]any{
+			"metadata": map[string]any{"name": name, "namespace": "default", "uid": uid},
+			"spec":     map[string]any{"clusterIPs": ips},
+		})
+	}
+	client := newFakeClient(
+		[]fakeList{{items: []json.RawMessage{svc("uid-web", "web", "10.96.0.10")}, resourceVersion: "1"}},
+		[]fakeWatch{{
+			events: []watchEvent{
+				{Type: "ADDED", Object: svc("uid-db", "db", "10.96.0.20", "fd00::20")},
+				{Type: "MODIFIED", Object: svc("uid-web", "web", "10.96.0.11")},
+				{Type: "DELETED", Object: svc("uid-db", "db", "10.96.0.20", "fd00::20")},
+			},
+		}},
+	)
+	services := newServiceStore()
+	runSync(t, client, servicesPath, services)
+
+	tests := []struct {
+		addr string
+		want string
+	}{
+		{"10.96.0.10", ""},
+		{"10.96.0.11", "web"},
+		{"10.96.0.20", ""},
+		{"fd00::20", ""},
+	}
+	for _, tt := range tests {
+		got := ""
+		if info := services.byAddr(netip.MustParseAddr(tt.addr)); info != nil {
+			got = info.Name
+		}
+		if got != tt.want {
+			t.Errorf("byAddr(%s) = %q, want %q", tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestWorkload(t *testing.T) {
+	tests := []struct {
+		name     string
+		meta     objectMeta
+		wantKind string
+		wantName string
+	}{
+		{
+			name: "deployment",
+			meta: objectMeta{
+				Name:            "web-7d4b9c8f6d-x2x9z",
+				Labels:          map[string]string{"pod-template-hash": "7d4b9c8f6d"},
+				OwnerReferences: []ownerReference{{Kind: "ReplicaSet", Name: "web-7d4b9c8f6d", Controller: true}},
+			},
+			wantKind: "Deployment",
+			wantName: "web",
+		},
+		{
+			name: "bare replicaset",
+			meta: objectMeta{
+				Name:            "web-x2x9z",
+				OwnerReferences: []ownerReference{{Kind: "ReplicaSet", Name: "web", Controller: true}},
+			},
+			wantKind: "ReplicaSet",
+			wantName: "web",
+		},
+		{
+			name: "statefulset",
+			meta: objectMeta{
+				Name:            "db-0",
+				OwnerReferences: []ownerReference{{Kind: "StatefulSet", Name: "db", Controller: true}},
+			},
+			wantKind: "StatefulSet",
+			wantName: "db",
+		},
+		{
+			name: "owner that is not the controller",
+			meta: objectMeta{
+				Name:            "job-pod",
+				OwnerReferences: []ownerReference{{Kind: "ConfigMap", Name: "settings"}},
+			},
+			wantKind: "Pod",
+			wantName: "job-pod",
+		},
+		{
+			name:     "standalone",
+			meta:     objectMeta{Name: "debug"},
+			wantKind: "Pod",
+			wantName: "debug",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kind, name := workload(tt.meta)
+			if kind != tt.wantKind || name != tt.wantName {
+				t.Errorf("workload() = %s/%s, want %s/%s", kind, name, tt.wantKind, tt.wantName)
+			}
+		})
+	}
+}
+
+func TestPodByCgroup(t *testing.T) {
+	const (
+		uid         = "1b4e5c3a-0d2f-4c7e-9a51-3f6a2c8e7d10"
+		containerID = "4f6c0d7e9a2b4c1d8e3f5a6b7c8d9e0f1a2b3c4d5e6f7a8b9c0d1e2f3a4b5c6d"
+	)
+	pods := newPodStore()
+	if err := pods.replace([]json.RawMessage{testPod(t, uid, "web", "1", "10.0.0.1", containerID)}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		cgroup types.CgroupInfo
+		want   string
+	}{
+		{
+			name:   "container ID",
+			cgroup: types.CgroupInfo{ContainerID: containerID},
+			want:   "web",
+		},
+		{
+			name:   "cgroupfs driver",
+			cgroup: types.CgroupInfo{Path: "/kubepods/burstable/pod" + uid + "/0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"},
+			want:   "web",
+		},
+		{
+			name: "systemd driver",
+			cgroup: types.CgroupInfo{
+				Path: "/kubepods.slice/kubepods-burstable.slice/kubepods-burstable-pod1b4e5c3a_0d2f_4c7e_9a51_3f6a2c8e7d10.slice/cri-containerd-0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef.scope",
+			},
+			want: "web",
+		},
+		{
+			name:   "unknown pod",
+			cgroup: types.CgroupInfo{Path: "/kubepods/besteffort/pod00000000-0000-0000-0000-000000000000"},
+		},
+		{
+			name:   "not a pod",
+			cgroup: types.CgroupInfo{Path: "/system.slice/sshd.service"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := podName(pods.byCgroup(tt.cgroup)); got != tt.want {
+				t.Errorf("byCgroup() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,169 @@
+package kubernetes
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+const (
+	serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+	tokenFile         = serviceAccountDir + "/token"
+	caFile            = serviceAccountDir + "/ca.crt"
+
+	listPageSize = 500
+	// The API server ends watches after this long, they are resumed from the
+	// last resource version.
+	watchTimeoutSeconds = 300
+)
+
+type Config struct {
+	// Enabled watches pods and Services to label connections with the
+	// workload on both ends.
+	Enabled bool `yaml:"enabled"`
+	// APIServer overrides the in-cluster API server URL. The pod's service
+	// account credentials are used either way.
+	APIServer string `yaml:"api_server"`
+}
+
+// errGone means the resource version to watch from is too old and the
+// resource has to be listed again.
+var errGone = errors.New("resource version too old")
+
+// apiClient lists and watches API resources, e.g. "/api/v1/pods".
+type apiClient interface {
+	list(ctx context.Context, path string) (items []json.RawMessage, resourceVersion string, err error)
+	watch(ctx context.Context, path, resourceVersion string, handle func(watchEvent) error) error
+}
+
+// client talks to the API server with the pod's service account. Only the
+// list and watch calls the cache needs are implemented.
+type client struct {
+	server string
+	http   *http.Client
+}
+
+func newClient(config Config) (*client, error) {
+	server := config.APIServer
+	if server == "" {
+		host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if host == "" || port == "" {
+			return nil, errors.New("not running in a cluster and no api_server configured")
+		}
+		server = "https://" + net.JoinHostPort(host, port)
+	}
+
+	ca, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read service account CA: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("no certificates in %s", caFile)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+
+	return &client{
+		server: strings.TrimSuffix(server, "/"),
+		http:   &http.Client{Transport: transport},
+	}, nil
+}
+
+// get issues a GET request. The token is read for every request, the
+// kubelet rotates it.
+func (c *client) get(ctx context.Context, path string, query url.Values) (*http.Response, error) {
+	token, err := os.ReadFile(tokenFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read service account token: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.server+path+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		if resp.StatusCode == http.StatusGone {
+			return nil, errGone
+		}
+		return nil, fmt.Errorf("GET %s: %s: %s", path, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return resp, nil
+}
+
+func (c *client) list(ctx context.Context, path string) ([]json.RawMessage, string, error) {
+	var items []json.RawMessage
+	query := url.Values{"limit": {fmt.Sprint(listPageSize)}}
+
+	for {
+		resp, err := c.get(ctx, path, query)
+		if err != nil {
+			return nil, "", err
+		}
+		var page objectList
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to decode %s: %w", path, err)
+		}
+
+		items = append(items, page.Items...)
+		if page.Metadata.Continue == "" {
+			return items, page.Metadata.ResourceVersion, nil
+		}
+		query.Set("continue", page.Metadata.Continue)
+	}
+}
+
+func (c *client) watch(ctx context.Context, path, resourceVersion string, handle func(watchEvent) error) error {
+	resp, err := c.get(ctx, path, url.Values{
+		"watch":               {"1"},
+		"resourceVersion":     {resourceVersion},
+		"allowWatchBookmarks": {"true"},
+		"timeoutSeconds":      {fmt.Sprint(watchTimeoutSeconds)},
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var event watchEvent
+		if err := decoder.Decode(&event); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return fmt.Errorf("failed to decode %s watch: %w", path, err)
+		}
+		if event.Type == "ERROR" {
+			var status status
+			if err := json.Unmarshal(event.Object, &status); err == nil && status.Code == http.StatusGone {
+				return errGone
+			}
+			return fmt.Errorf("%s watch failed: %s", path, event.Object)
+		}
+		if err := handle(event); err != nil {
+			return err
+		}
+	}
+}
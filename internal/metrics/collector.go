@@ -3,6 +3,7 @@ package metrics
 import (
 	"context"
 	"log/slog"
+	"maps"
 	"sync"
 	"time"
 
@@ -10,27 +11,71 @@ import (
 	"github.com/pedrospdc/gespann/pkg/types"
 )
 
+// ConnectionSource lists the connections the kernel is tracking.
+type ConnectionSource interface {
+	Connections() (types.KernelConnections, error)
+}
+
+// TCPStateSource counts the TCP state changes the kernel saw: by state, the
+// sockets that entered it minus those that left it.
+type TCPStateSource interface {
+	TCPStateMoves() (map[types.TCPState]int64, error)
+}
+
 type Collector struct {
 	adapters []adapters.MetricsAdapter
 	metrics  types.ConnMetrics
 	mutex    sync.RWMutex
 	logger   *slog.Logger
+
+	// open is the userspace connection table, the open and idle gauges
+	// follow it so an event seen twice does not count twice.
+	open map[types.ConnKey]openConn
+
+	// The TCP state gauges are stateBase plus the kernel's stateMoves.
+	// stateBase is set by reconciliation, to the sockets sock_diag listed
+	// less the moves counted at the time.
+	states     TCPStateSource
+	stateBase  map[types.TCPState]int64
+	stateMoves map[types.TCPState]int64
+}
+
+// openConn is an entry of the connection table.
+type openConn struct {
+	direction types.Direction
+	idle      bool
 }
 
 func NewCollector(adapters []adapters.MetricsAdapter, logger *slog.Logger) *Collector {
 	return &Collector{
 		adapters: adapters,
-		logger:   logger,
+		metrics: types.ConnMetrics{
+			TCPStates: make(map[types.TCPState]int64),
+		},
+		logger:    logger,
+		open:      make(map[types.ConnKey]openConn),
+		stateBase: make(map[types.TCPState]int64),
 	}
 }
 
+// SetTCPStateSource sets where the TCP state gauges are read from. Without
+// one they stay empty. Call it before Start and Reconcile.
+func (c *Collector) SetTCPStateSource(source TCPStateSource) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.states = source
+}
+
 func (c *Collector) ProcessEvent(event types.ConnEvent) {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
 
+	direction := c.directionMetrics(event.Direction)
+
 	switch event.Type {
 	case types.ConnOpen:
-		c.metrics.OpenConnections++
+		c.track(event.Key(), event.Direction)
 		c.metrics.TotalConnections++
 		switch event.Protocol {
 		case types.ProtoTCP:
@@ -38,18 +83,34 @@ func (c *Collector) ProcessEvent(event types.ConnEvent) {
 		case types.ProtoUDP:
 			c.metrics.UDPConnections++
 		}
+	case types.ConnExisting:
+		// Already open, counted open but not as a new connection. Its TCP
+		// state is counted by the reconciliation baseline.
+		c.track(event.Key(), event.Direction)
 	case types.ConnClose:
-		c.metrics.OpenConnections--
+		c.untrack(event.Key())
 		c.metrics.ClosedConnections++
 		c.updatePerformanceMetrics(event)
+		c.updateDirectionMetrics(direction, event)
 	case types.ConnReset:
-		c.metrics.OpenConnections--
+		c.untrack(event.Key())
 		c.metrics.ResetConnections++
 		c.updatePerformanceMetrics(event)
+		c.updateDirectionMetrics(direction, event)
 	case types.ConnFailed:
+		// Failed connects were reported open by tcp_connect
+		c.untrack(event.Key())
 		c.metrics.FailedConnections++
+		c.updateConnectLatency(event)
+	case types.ConnData:
+		c.updatePerformanceMetrics(event)
+		c.addDirectionBytes(direction, event)
 	case types.ConnIdle:
-		c.metrics.IdleConnections++
+		c.setIdle(event.Key(), true)
+	case types.ConnActive:
+		c.setIdle(event.Key(), false)
+	case types.ConnStateChange:
+		c.updateConnectLatency(event)
 	}
 
 	for _, adapter := range c.adapters {
@@ -59,9 +120,220 @@ func (c *Collector) ProcessEvent(event types.ConnEvent) {
 	}
 }
 
+// track counts a connection open unless it is already.
+func (c *Collector) track(key types.ConnKey, d types.Direction) {
+	if _, ok := c.open[key]; ok {
+		return
+	}
+	c.open[key] = openConn{direction: d}
+	c.metrics.OpenConnections++
+	if direction := c.directionMetrics(d); direction != nil {
+		direction.OpenConnections++
+	}
+}
+
+// untrack stops counting a connection open, and idle, if it was.
+func (c *Collector) untrack(key types.ConnKey) {
+	conn, ok := c.open[key]
+	if !ok {
+		return
+	}
+	delete(c.open, key)
+	c.metrics.OpenConnections--
+	if conn.idle {
+		c.metrics.IdleConnections--
+	}
+	if direction := c.directionMetrics(conn.direction); direction != nil {
+		direction.OpenConnections--
+	}
+}
+
+// setIdle counts a tracked connection idle or active, if it is not already.
+func (c *Collector) setIdle(key types.ConnKey, idle bool) {
+	conn, ok := c.open[key]
+	if !ok || conn.idle == idle {
+		return
+	}
+	conn.idle = idle
+	c.open[key] = conn
+	if idle {
+		c.metrics.IdleConnections++
+	} else {
+		c.metrics.IdleConnections--
+	}
+}
+
+// Reconcile compares the connection table and the TCP state gauges with
+// the kernel's, right away and then every interval, and corrects them for
+// events that were lost. Events may still be on their way when the kernel
+// is read, so a difference is only corrected when the previous pass saw it
+// too. The first pass sets the TCP state gauges, sockets already in a state
+// when the probes were attached never report entering it.
+func (c *Collector) Reconcile(ctx context.Context, source ConnectionSource, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var (
+		missing, stale map[types.ConnKey]bool
+		// nil until the TCP state gauges have their baseline
+		differing map[types.TCPState]bool
+	)
+	pass := func() {
+		kernel, err := source.Connections()
+		if err != nil {
+			c.logger.Warn("failed to list kernel connections", "error", err)
+			return
+		}
+		missing, stale = c.reconcile(kernel.Open, missing, stale)
+		if kernel.TCPStates == nil || c.states == nil {
+			return
+		}
+		moves, err := c.states.TCPStateMoves()
+		if err != nil {
+			c.logger.Warn("failed to read TCP state counts", "error", err)
+			return
+		}
+		differing = c.reconcileTCPStates(kernel.TCPStates, moves, differing)
+	}
+
+	pass()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			pass()
+		}
+	}
+}
+
+// reconcile corrects the differences with the kernel seen twice in a row
+// and returns the ones seen for the first time: connections missing from
+// the table and connections the kernel no longer tracks.
+func (c *Collector) reconcile(kernel map[types.ConnKey]types.Direction, wasMissing, wasStale map[types.ConnKey]bool) (missing, stale map[types.ConnKey]bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	missing = make(map[types.ConnKey]bool)
+	stale = make(map[types.ConnKey]bool)
+	var added, removed int64
+
+	for key, d := range kernel {
+		if _, ok := c.open[key]; ok {
+			continue
+		}
+		if wasMissing[key] {
+			c.track(key, d)
+			added++
+		} else {
+			missing[key] = true
+		}
+	}
+
+	for key := range c.open {
+		if _, ok := kernel[key]; ok {
+			continue
+		}
+		if wasStale[key] {
+			c.untrack(key)
+			removed++
+		} else {
+			stale[key] = true
+		}
+	}
+
+	if added > 0 || removed > 0 {
+		c.logger.Info("corrected open connections from kernel state", "added", added, "removed", removed)
+	}
+	c.metrics.Corrections.Added += added
+	c.metrics.Corrections.Removed += removed
+	return missing, stale
+}
+
+// reconcileTCPStates rebases the gauges of the states sock_diag counted
+// that differ from its count on this pass and the previous one, and
+// returns the ones differing for the first time. Without a previous pass,
+// every gauge is rebased.
+func (c *Collector) reconcileTCPStates(kernel, moves map[types.TCPState]int64, wasDiffering map[types.TCPState]bool) map[types.TCPState]bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.stateMoves = moves
+	differing := make(map[types.TCPState]bool)
+	var corrected []types.TCPState
+	for state, count := range kernel {
+		if c.stateBase[state]+moves[state] == count {
+			continue
+		}
+		if wasDiffering != nil && !wasDiffering[state] {
+			differing[state] = true
+			continue
+		}
+		if wasDiffering != nil {
+			corrected = append(corrected, state)
+		}
+		c.stateBase[state] = count - moves[state]
+	}
+	c.updateTCPStates()
+
+	if len(corrected) > 0 {
+		c.logger.Info("corrected TCP state gauges from kernel state", "states", corrected)
+	}
+	return differing
+}
+
+// refreshTCPStates reads the kernel's state moves for a report.
+func (c *Collector) refreshTCPStates() {
+	c.mutex.RLock()
+	source := c.states
+	c.mutex.RUnlock()
+	if source == nil {
+		return
+	}
+
+	moves, err := source.TCPStateMoves()
+	if err != nil {
+		c.logger.Warn("failed to read TCP state counts", "error", err)
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.stateMoves = moves
+	c.updateTCPStates()
+}
+
+// ProcessDNSEvent forwards a completed or timed out DNS lookup to the adapters.
+func (c *Collector) ProcessDNSEvent(event types.DNSEvent) {
+	for _, adapter := range c.adapters {
+		if err := adapter.SendDNSEvent(context.Background(), event); err != nil {
+			c.logger.Error("failed to send DNS event to adapter", "error", err)
+		}
+	}
+}
+
+// SetProbeStatus records the attach state of the tracker's probes so it is
+// reported alongside the connection metrics.
+func (c *Collector) SetProbeStatus(probes []types.ProbeStatus) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.metrics.Probes = probes
+}
+
+// SetProgram records the program set the tracker was asked for and the one
+// it loaded.
+func (c *Collector) SetProgram(program types.TrackerProgram) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.metrics.Program = program
+}
+
 func (c *Collector) updatePerformanceMetrics(event types.ConnEvent) {
 	c.metrics.TotalBytesSent += event.BytesSent
 	c.metrics.TotalBytesReceived += event.BytesReceived
+	c.metrics.TotalRetransmits += uint64(event.Retransmits)
 
 	// Simple moving average for RTT and duration
 	if event.RTTMicros > 0 {
@@ -72,6 +344,57 @@ func (c *Collector) updatePerformanceMetrics(event types.ConnEvent) {
 	}
 }
 
+// updateConnectLatency averages the handshake latency carried by the
+// SYN_SENT -> ESTABLISHED transition and by failed connects.
+func (c *Collector) updateConnectLatency(event types.ConnEvent) {
+	if event.ConnectMicros > 0 {
+		c.metrics.AvgConnectLatency = (c.metrics.AvgConnectLatency + float64(event.ConnectMicros)) / 2.0
+	}
+}
+
+// updateTCPStates sets the state gauges from their base and the kernel's
+// moves.
+func (c *Collector) updateTCPStates() {
+	for state, base := range c.stateBase {
+		c.metrics.TCPStates[state] = base + c.stateMoves[state]
+	}
+	for state, moved := range c.stateMoves {
+		if state == types.TCPClose || state == types.TCPUnknown {
+			continue
+		}
+		c.metrics.TCPStates[state] = c.stateBase[state] + moved
+	}
+}
+
+// directionMetrics returns the per-direction counters for d, or nil when the
+// direction is unknown.
+func (c *Collector) directionMetrics(d types.Direction) *types.DirectionMetrics {
+	switch d {
+	case types.DirectionInbound:
+		return &c.metrics.Inbound
+	case types.DirectionOutbound:
+		return &c.metrics.Outbound
+	default:
+		return nil
+	}
+}
+
+func (c *Collector) updateDirectionMetrics(direction *types.DirectionMetrics, event types.ConnEvent) {
+	if direction == nil {
+		return
+	}
+	direction.ClosedConnections++
+	c.addDirectionBytes(direction, event)
+}
+
+func (c *Collector) addDirectionBytes(direction *types.DirectionMetrics, event types.ConnEvent) {
+	if direction == nil {
+		return
+	}
+	direction.TotalBytesSent += event.BytesSent
+	direction.TotalBytesReceived += event.BytesReceived
+}
+
 func (c *Collector) Start(ctx context.Context, interval time.Duration) {
 	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
@@ -81,9 +404,14 @@ func (c *Collector) Start(ctx context.Context, interval time.Duration) {
 		case <-ctx.Done():
 			return
 		case <-ticker.C:
-			c.mutex.RLock()
+			c.refreshTCPStates()
+
+			c.mutex.Lock()
 			currentMetrics := c.metrics
-			c.mutex.RUnlock()
+			currentMetrics.TCPStates = maps.Clone(c.metrics.TCPStates)
+			// Corrections are reported once
+			c.metrics.Corrections = types.ReconcileCorrections{}
+			c.mutex.Unlock()
 
 			for _, adapter := range c.adapters {
 				if err := adapter.SendMetrics(ctx, currentMetrics); err != nil {
@@ -0,0 +1,28 @@
+// Package procfs locates the proc and cgroup filesystems process and
+// cgroup details are read from.
+package procfs
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// Path is where procfs is mounted.
+const Path = "/proc"
+
+// cgroupRoots are the usual cgroup v2 mount points, the unified hierarchy
+// of hybrid setups first.
+var cgroupRoots = []string{"/sys/fs/cgroup/unified", "/sys/fs/cgroup"}
+
+// CgroupRoot returns where the cgroup v2 hierarchy is mounted.
+func CgroupRoot() (string, error) {
+	for _, root := range cgroupRoots {
+		var st unix.Statfs_t
+		if err := unix.Statfs(root, &st); err == nil && st.Type == unix.CGROUP2_SUPER_MAGIC {
+			return root, nil
+		}
+	}
+	return "", fmt.Errorf("no cgroup v2 hierarchy mounted at %s", strings.Join(cgroupRoots, " or "))
+}
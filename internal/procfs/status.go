@@ -0,0 +1,46 @@
+package procfs
+
+import (
+	"bufio"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ReadStatus returns the real UID and the PID in the innermost PID namespace
+// from a /proc/<pid>/status file, zero when not found. NSpid lists the PID
+// in every namespace from the outermost in.
+func ReadStatus(path string) (uid uint32, nsPID uint32) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, 0
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), ":")
+		if !ok {
+			continue
+		}
+		fields := strings.Fields(value)
+		if len(fields) == 0 {
+			continue
+		}
+		switch key {
+		case "Uid":
+			uid = parseUint32(fields[0])
+		case "NSpid":
+			nsPID = parseUint32(fields[len(fields)-1])
+		}
+	}
+	return uid, nsPID
+}
+
+func parseUint32(s string) uint32 {
+	n, err := strconv.ParseUint(s, 10, 32)
+	if err != nil {
+		return 0
+	}
+	return uint32(n)
+}
@@ -1,6 +1,9 @@
 package types
 
-import "time"
+import (
+	"net/netip"
+	"time"
+)
 
 type EventType uint8
 
@@ -11,6 +14,12 @@ const (
 	ConnReset
 	ConnFailed
 	ConnData
+	ConnStateChange
+	ConnActive
+	// ProcessExit reports that a process exited, it describes no connection
+	ProcessExit
+	// ConnExisting reports a connection that was open before gespann started
+	ConnExisting
 )
 
 type ProtocolType uint8
@@ -28,24 +37,179 @@ const (
 	ResetTimeout ResetReason = 1
 	ResetRefused ResetReason = 2
 	ResetAbort   ResetReason = 3
+	ResetLocal   ResetReason = 4
+	ResetRemote  ResetReason = 5
+)
+
+// FailureReason classifies why a connect attempt failed.
+type FailureReason uint8
+
+const (
+	FailureNone            FailureReason = 0
+	FailureRefused         FailureReason = 1
+	FailureTimeout         FailureReason = 2
+	FailureHostUnreachable FailureReason = 3
+	FailureNetUnreachable  FailureReason = 4
+	FailureAborted         FailureReason = 5
+	FailureOther           FailureReason = 6
 )
 
+type TCPState uint8
+
+const (
+	TCPUnknown     TCPState = 0
+	TCPEstablished TCPState = 1
+	TCPSynSent     TCPState = 2
+	TCPSynRecv     TCPState = 3
+	TCPFinWait1    TCPState = 4
+	TCPFinWait2    TCPState = 5
+	TCPTimeWait    TCPState = 6
+	TCPClose       TCPState = 7
+	TCPCloseWait   TCPState = 8
+	TCPLastAck     TCPState = 9
+	TCPListen      TCPState = 10
+	TCPClosing     TCPState = 11
+	TCPNewSynRecv  TCPState = 12
+)
+
+type Direction uint8
+
+const (
+	DirectionUnknown  Direction = 0
+	DirectionOutbound Direction = 1
+	DirectionInbound  Direction = 2
+)
+
+type ProbeState uint8
+
+const (
+	ProbeDetached    ProbeState = 0
+	ProbeAttached    ProbeState = 1
+	ProbeUnavailable ProbeState = 2
+	ProbeFailed      ProbeState = 3
+)
+
+// TrackerProgram is the eBPF program set asked for in the configuration and
+// the one that was loaded, they differ when "auto" or a fallback picked it.
+type TrackerProgram struct {
+	Requested string `json:"requested"`
+	Program   string `json:"program"`
+}
+
+type ProbeStatus struct {
+	Name     string     `json:"name"`
+	Required bool       `json:"required"`
+	State    ProbeState `json:"state"`
+	Error    string     `json:"error,omitempty"`
+}
+
 type ConnEvent struct {
-	PID           uint32       `json:"pid"`
-	TID           uint32       `json:"tid"`
-	SAddr         uint32       `json:"saddr"`
-	DAddr         uint32       `json:"daddr"`
-	SPort         uint16       `json:"sport"`
-	DPort         uint16       `json:"dport"`
-	Type          EventType    `json:"event_type"`
-	Protocol      ProtocolType `json:"protocol"`
-	Timestamp     time.Time    `json:"timestamp"`
-	BytesSent     uint64       `json:"bytes_sent"`
-	BytesReceived uint64       `json:"bytes_received"`
-	RTTMicros     uint32       `json:"rtt_microseconds"`
-	DurationMS    uint32       `json:"duration_ms"`
-	TCPState      uint8        `json:"tcp_state"`
-	ResetReason   ResetReason  `json:"reset_reason"`
+	// PID is the host TGID, NamespacedPID the same process in its own PID
+	// namespace, as seen inside its container. They are equal on the host
+	PID           uint32        `json:"pid"`
+	NamespacedPID uint32        `json:"ns_pid"`
+	TID           uint32        `json:"tid"`
+	Netns         uint32        `json:"netns"`
+	SAddr         netip.Addr    `json:"saddr"`
+	DAddr         netip.Addr    `json:"daddr"`
+	SPort         uint16        `json:"sport"`
+	DPort         uint16        `json:"dport"`
+	Type          EventType     `json:"event_type"`
+	Protocol      ProtocolType  `json:"protocol"`
+	Timestamp     time.Time     `json:"timestamp"`
+	BytesSent     uint64        `json:"bytes_sent"`
+	BytesReceived uint64        `json:"bytes_received"`
+	RTTMicros     uint32        `json:"rtt_microseconds"`
+	RTTVarMicros  uint32        `json:"rtt_var_microseconds"`
+	Retransmits   uint32        `json:"retransmits"`
+	RTOs          uint16        `json:"rto_count"`
+	LossProbes    uint16        `json:"tlp_count"`
+	Idle          bool          `json:"idle"`
+	DurationMS    uint32        `json:"duration_ms"`
+	ConnectMicros uint32        `json:"connect_microseconds"`
+	TCPState      TCPState      `json:"tcp_state"`
+	PrevTCPState  TCPState      `json:"prev_tcp_state"`
+	ResetReason   ResetReason   `json:"reset_reason"`
+	Direction     Direction     `json:"direction"`
+	FailureReason FailureReason `json:"failure_reason"`
+	// DestinationName is the hostname the destination was resolved from, if seen
+	DestinationName string `json:"destination_name,omitempty"`
+	// Process is the process that owns the connection
+	Process ProcessInfo `json:"process"`
+	// Cgroup is the cgroup of the process, and the container or unit it belongs to
+	Cgroup CgroupInfo `json:"cgroup"`
+	// Pod is the pod of the process, PeerPod and PeerService the pod or
+	// Service behind the remote address. Set when running in Kubernetes
+	Pod         *PodInfo     `json:"pod,omitempty"`
+	PeerPod     *PodInfo     `json:"peer_pod,omitempty"`
+	PeerService *ServiceInfo `json:"peer_service,omitempty"`
+}
+
+// ProcessInfo describes a process. Comm is captured in the kernel, the rest
+// is read from /proc and is empty when the process exited first.
+type ProcessInfo struct {
+	Comm    string `json:"comm"`
+	Exe     string `json:"exe,omitempty"`
+	Cmdline string `json:"cmdline,omitempty"`
+	UID     uint32 `json:"uid"`
+}
+
+// CgroupInfo describes a cgroup v2 cgroup. ID is captured in the kernel, the
+// rest is derived from its path and is empty when it could not be resolved.
+type CgroupInfo struct {
+	ID          uint64 `json:"id"`
+	Path        string `json:"path,omitempty"`
+	ContainerID string `json:"container_id,omitempty"`
+	Runtime     string `json:"container_runtime,omitempty"`
+	SystemdUnit string `json:"systemd_unit,omitempty"`
+}
+
+// ConnKey identifies a connection. Addresses are only unique within a
+// network namespace, containers reuse them.
+type ConnKey struct {
+	Netns    uint32
+	Protocol ProtocolType
+	SAddr    netip.Addr
+	DAddr    netip.Addr
+	SPort    uint16
+	DPort    uint16
+}
+
+// KernelConnections is the kernel's view of the traced connections, the
+// userspace one is reconciled with it.
+type KernelConnections struct {
+	// Open are the connections the probes are tracking, with their direction.
+	Open map[ConnKey]Direction
+	// TCPStates counts the TCP sockets by state, for every state the probes
+	// see sockets enter and leave. Nil when not every namespace could be listed.
+	TCPStates map[TCPState]int64
+}
+
+// Key returns the key of the connection the event belongs to.
+func (e ConnEvent) Key() ConnKey {
+	return ConnKey{
+		Netns:    e.Netns,
+		Protocol: e.Protocol,
+		SAddr:    e.SAddr,
+		DAddr:    e.DAddr,
+		SPort:    e.SPort,
+		DPort:    e.DPort,
+	}
+}
+
+type DirectionMetrics struct {
+	OpenConnections    int64  `json:"open_connections"`
+	ClosedConnections  int64  `json:"closed_connections"`
+	TotalBytesSent     uint64 `json:"total_bytes_sent"`
+	TotalBytesReceived uint64 `json:"total_bytes_received"`
+}
+
+// ReconcileCorrections counts connections the reconciliation with the
+// kernel added to or removed from the open connections, because their open
+// or teardown event was lost.
+type ReconcileCorrections struct {
+	Added   int64 `json:"added"`
+	Removed int64 `json:"removed"`
 }
 
 type ConnMetrics struct {
@@ -62,8 +226,23 @@ type ConnMetrics struct {
 	TotalBytesReceived    uint64  `json:"total_bytes_received"`
 	AvgConnectionDuration float64 `json:"avg_connection_duration_ms"`
 	AvgRTT                float64 `json:"avg_rtt_microseconds"`
+	AvgConnectLatency     float64 `json:"avg_connect_latency_microseconds"`
+	TotalRetransmits      uint64  `json:"total_retransmits"`
 
 	// Protocol distribution
 	TCPConnections int64 `json:"tcp_connections"`
 	UDPConnections int64 `json:"udp_connections"`
+
+	// TCP sockets per state, driven by state transitions
+	TCPStates map[TCPState]int64 `json:"tcp_states"`
+
+	// Direction distribution
+	Inbound  DirectionMetrics `json:"inbound"`
+	Outbound DirectionMetrics `json:"outbound"`
+
+	// Tracker self-metrics
+	Program TrackerProgram `json:"program"`
+	Probes  []ProbeStatus  `json:"probes"`
+	// Corrections made since the previous report
+	Corrections ReconcileCorrections `json:"reconcile_corrections"`
 }
@@ -0,0 +1,50 @@
+package types
+
+import (
+	"net/netip"
+	"time"
+)
+
+// DNSPacket is a raw DNS message sent or received on a UDP socket, or a
+// piece of a TCP DNS stream. Size is the length of the datagram or piece,
+// Payload holds up to its first 512 bytes.
+type DNSPacket struct {
+	PID           uint32
+	NamespacedPID uint32
+	Comm          string
+	Netns         uint32
+	Timestamp     time.Time
+	Protocol      ProtocolType
+	Local         netip.AddrPort
+	Remote        netip.AddrPort
+	Outbound      bool
+	Size          int
+	Payload       []byte
+}
+
+// DNSEvent is a DNS query matched with its response, or a query that got
+// no response in time.
+type DNSEvent struct {
+	// PID is the host TGID of the process that sent the query,
+	// NamespacedPID the same process in its own PID namespace
+	PID           uint32         `json:"pid"`
+	NamespacedPID uint32         `json:"ns_pid"`
+	Process       ProcessInfo    `json:"process"`
+	Timestamp     time.Time      `json:"timestamp"`
+	Protocol      ProtocolType   `json:"protocol"`
+	Server        netip.AddrPort `json:"server"`
+	Name          string         `json:"name"`
+	QType         uint16         `json:"qtype"`
+	RCode         uint8          `json:"rcode"`
+	TimedOut      bool           `json:"timed_out"`
+	Latency       time.Duration  `json:"latency"`
+	Answers       []netip.Addr   `json:"answers"`
+}
+
+// Resolution is a hostname a process resolved through getaddrinfo.
+type Resolution struct {
+	PID       uint32
+	Timestamp time.Time
+	Hostname  string
+	Addrs     []netip.Addr
+}
@@ -0,0 +1,18 @@
+package types
+
+// PodInfo identifies a Kubernetes pod and the workload that owns it.
+type PodInfo struct {
+	Name      string            `json:"name"`
+	Namespace string            `json:"namespace"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	// WorkloadKind is the kind of the controller owning the pod, e.g.
+	// Deployment, StatefulSet or DaemonSet, or "Pod" for bare pods
+	WorkloadKind string `json:"workload_kind"`
+	Workload     string `json:"workload"`
+}
+
+// ServiceInfo identifies a Kubernetes Service.
+type ServiceInfo struct {
+	Name      string `json:"name"`
+	Namespace string `json:"namespace"`
+}